@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"io"
+)
+
+// assetSink stores the images of an export. By default they are files in
+// the output next to the Markdown (localAssets); with -image-store they are
+// uploaded to an object store and linked by URL (bucketAssets).
+type assetSink interface {
+	// URL returns the absolute URL the image stored at the slash-separated
+	// path rel is served from, or "" if images are linked relative to the
+	// Markdown file. rel may be a directory ending in "/".
+	URL(rel string) string
+	// Has reports whether the image a previous export recorded as e is
+	// still stored with the same content.
+	Has(ctx context.Context, e ManifestEntry) bool
+	// Put stores an image at rel, with the content produced by write.
+	Put(ctx context.Context, rel string, write func(io.Writer) error) error
+}
+
+// assetSink returns where the images of document docID go: the store given
+// with -image-store if any, otherwise stage, the export's output.
+func (o ExportOptions) assetSink(stage outputSink, outputDir, docID string) assetSink {
+	if o.ImageStore != nil {
+		return o.ImageStore.document(docID)
+	}
+	return &localAssets{stage: stage, outputDir: outputDir}
+}
+
+// localAssets writes images into the export's output.
+type localAssets struct {
+	stage     outputSink
+	outputDir string
+}
+
+func (a *localAssets) URL(string) string { return "" }
+
+func (a *localAssets) Has(_ context.Context, e ManifestEntry) bool {
+	return e.URL == "" && fileMatches(a.outputDir, e)
+}
+
+func (a *localAssets) Put(_ context.Context, rel string, write func(io.Writer) error) error {
+	destPath, err := a.stage.Path(rel)
+	if err != nil {
+		return err
+	}
+	return createAtomic(destPath, 0644, write)
+}
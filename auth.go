@@ -16,6 +16,7 @@ import (
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	docsv1 "google.golang.org/api/docs/v1"
+	drive "google.golang.org/api/drive/v3"
 )
 
 const (
@@ -71,7 +72,7 @@ func SaveAppConfig(cfg *AppConfig) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filepath.Join(dir, configFile), data, 0600)
+	return writeFileAtomic(filepath.Join(dir, configFile), data, 0600)
 }
 
 func tokenPath() (string, error) {
@@ -107,7 +108,7 @@ func saveToken(tok *oauth2.Token) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0600)
+	return writeFileAtomic(path, data, 0600)
 }
 
 func oauthConfig(appCfg *AppConfig, redirectURL string) *oauth2.Config {
@@ -115,7 +116,7 @@ func oauthConfig(appCfg *AppConfig, redirectURL string) *oauth2.Config {
 		ClientID:     appCfg.ClientID,
 		ClientSecret: appCfg.ClientSecret,
 		RedirectURL:  redirectURL,
-		Scopes:       []string{docsv1.DocumentsReadonlyScope},
+		Scopes:       []string{docsv1.DocumentsReadonlyScope, drive.DriveReadonlyScope},
 		Endpoint:     google.Endpoint,
 	}
 }
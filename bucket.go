@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// bucketStore uploads images to a bucket of an S3-compatible object store,
+// such as AWS S3 or MinIO. Buckets are addressed path-style
+// (endpoint/bucket/key) and requests are signed with AWS Signature
+// Version 4, using credentials from the standard AWS environment variables.
+type bucketStore struct {
+	client   *http.Client
+	endpoint *url.URL
+	bucket   string
+	prefix   string // key prefix, without leading or trailing slashes
+	region   string
+	// publicURL is what image links start with: the bucket's own URL, or
+	// -image-url for a bucket served through a CDN or website endpoint.
+	publicURL string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newBucketStore parses an -image-store argument of the form
+// s3://bucket/prefix. endpoint and publicURL may be empty for the
+// defaults: AWS_ENDPOINT_URL_S3, AWS_ENDPOINT_URL or the AWS S3 endpoint of
+// the region, and the bucket's URL on that endpoint.
+func newBucketStore(spec, endpoint, publicURL string, client *http.Client) (*bucketStore, error) {
+	rest, ok := strings.CutPrefix(spec, "s3://")
+	if !ok {
+		return nil, fmt.Errorf("unsupported image store %q (want s3://bucket/prefix)", spec)
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("image store %q names no bucket", spec)
+	}
+
+	s := &bucketStore{
+		client:       client,
+		bucket:       bucket,
+		prefix:       strings.Trim(prefix, "/"),
+		region:       firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("uploading images to %s needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", spec)
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid object store endpoint %q", endpoint)
+	}
+	s.endpoint = u
+	if publicURL == "" {
+		publicURL = strings.TrimSuffix(u.String(), "/") + "/" + bucket
+	}
+	s.publicURL = strings.TrimSuffix(publicURL, "/")
+	return s, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// String identifies the store in the manifest's options fingerprint.
+func (s *bucketStore) String() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("s3://%s/%s@%s", s.bucket, s.prefix, s.endpoint.Host)
+}
+
+// document returns the sink for the images of one document. Their keys
+// start with the document ID, so documents sharing a bucket and prefix do
+// not overwrite each other's images.
+func (s *bucketStore) document(docID string) *bucketAssets {
+	return &bucketAssets{store: s, prefix: path.Join(s.prefix, docID)}
+}
+
+// bucketAssets stores images at prefix/rel in a bucket.
+type bucketAssets struct {
+	store  *bucketStore
+	prefix string
+}
+
+func (a *bucketAssets) key(rel string) string {
+	key := path.Join(a.prefix, rel)
+	if strings.HasSuffix(rel, "/") {
+		key += "/"
+	}
+	return key
+}
+
+func (a *bucketAssets) URL(rel string) string {
+	return a.store.publicURL + "/" + linkTarget(a.key(rel))
+}
+
+// Has checks the object's size and the content hash recorded in its
+// metadata on upload.
+func (a *bucketAssets) Has(ctx context.Context, e ManifestEntry) bool {
+	if e.URL != a.URL(e.Path) {
+		return false
+	}
+	req, err := a.store.request(ctx, http.MethodHead, a.key(e.Path), nil, 0)
+	if err != nil {
+		return false
+	}
+	a.store.sign(req, emptyPayloadHash, time.Now())
+	resp, err := a.store.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK &&
+		resp.Header.Get("X-Amz-Meta-Sha256") == e.SHA256 &&
+		(e.Size == 0 || resp.ContentLength == e.Size)
+}
+
+// Put spools the image to a temporary file, since a signed upload needs
+// its length and hash up front, and then uploads it.
+func (a *bucketAssets) Put(ctx context.Context, rel string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp("", "gdoc2md-upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if err := write(io.MultiWriter(tmp, h)); err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	key := a.key(rel)
+	req, err := a.store.request(ctx, http.MethodPut, key, io.NewSectionReader(tmp, 0, size), size)
+	if err != nil {
+		return err
+	}
+	if ctype := mime.TypeByExtension(path.Ext(rel)); ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	req.Header.Set("X-Amz-Meta-Sha256", sum)
+	a.store.sign(req, sum, time.Now())
+
+	resp, err := a.store.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("failed to upload %s: %w", key, &httpStatusError{StatusCode: resp.StatusCode})
+		if msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)); len(bytes.TrimSpace(msg)) > 0 {
+			err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(msg))
+		}
+		return err
+	}
+	return nil
+}
+
+// request builds a request for the object key. A body is sent from the
+// start again if the request is retried.
+func (s *bucketStore) request(ctx context.Context, method, key string, body *io.SectionReader, size int64) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket + "/" + key
+	u.RawPath = "/" + s3Escape(s.bucket) + "/" + s3Escape(key)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = io.NopCloser(body)
+		req.ContentLength = size
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(body, 0, size)), nil
+		}
+	}
+	return req, nil
+}
+
+// emptyPayloadHash is the SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds AWS Signature Version 4 headers to req, whose body has the
+// SHA-256 payloadHash. The host and every header already set on req are
+// signed. Requests carry no query parameters, so the canonical query
+// string is empty.
+func (s *bucketStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashBytes([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes an object key the way Signature Version 4
+// expects: everything but unreserved characters and slashes.
+func s3Escape(key string) string {
+	var sb strings.Builder
+	for _, b := range []byte(key) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/':
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
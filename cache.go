@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imageCache keeps downloaded images under the config directory, so that
+// exporting a document again, into another directory or as an archive,
+// does not download its unchanged images again. Entries are keyed by
+// document and image object ID (see imageCacheKey), since content URIs are
+// signed, short-lived URLs that change with every fetch of the document.
+// An entry the server gave an ETag or Last-Modified date is revalidated
+// with a conditional request to the current URI; one without is reused as
+// long as the cached file still has the content hash recorded for it.
+// When the cache outgrows its size limit, the least recently used entries
+// are evicted.
+type imageCache struct {
+	dir     string
+	maxSize int64 // bytes; 0 means no limit
+
+	mu sync.Mutex // serializes eviction
+}
+
+// cacheEntry is stored next to each cached image as <key>.json.
+type cacheEntry struct {
+	Key string `json:"key"`
+	// URI is the content URI the image was last downloaded from.
+	URI          string `json:"uri"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	SHA256       string `json:"sha256"`
+	Size         int64  `json:"size"`
+}
+
+// errCacheCorrupt is returned when a cached image no longer matches its
+// recorded hash.
+var errCacheCorrupt = errors.New("cached image is corrupt")
+
+func imageCacheDir() (string, error) {
+	dir, err := configDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cache", "images"), nil
+}
+
+// newImageCache opens the image cache, creating it if needed.
+func newImageCache(maxSize int64) (*imageCache, error) {
+	dir, err := imageCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create image cache: %w", err)
+	}
+	return &imageCache{dir: dir, maxSize: maxSize}, nil
+}
+
+// imageCacheKey identifies an image in the cache: by the ID of its inline
+// object within the document, which stays the same as long as the image
+// is not replaced, or by its content URI if it has no object ID.
+func imageCacheKey(docID string, img ImageRef) string {
+	if docID == "" || img.ObjectID == "" {
+		return img.ContentURI
+	}
+	return docID + "/" + img.ObjectID
+}
+
+// paths returns the files holding the content and the entry for key.
+func (c *imageCache) paths(key string) (data, entry string) {
+	data = filepath.Join(c.dir, hashBytes([]byte(key)))
+	return data, data + ".json"
+}
+
+// lookup returns the entry cached for key, or nil if there is none.
+func (c *imageCache) lookup(key string) *cacheEntry {
+	if c == nil {
+		return nil
+	}
+	dataPath, entryPath := c.paths(key)
+	raw, err := os.ReadFile(entryPath)
+	if err != nil {
+		return nil
+	}
+	var e cacheEntry
+	if json.Unmarshal(raw, &e) != nil || e.Key != key {
+		return nil
+	}
+	if info, err := os.Stat(dataPath); err != nil || info.Size() != e.Size {
+		return nil
+	}
+	return &e
+}
+
+// revalidate reports whether the server must be asked if e is still
+// current before it is used.
+func (e *cacheEntry) revalidate() bool {
+	return e.ETag != "" || e.LastModified != ""
+}
+
+// setValidators makes req conditional on the content having changed
+// since e was cached.
+func (e *cacheEntry) setValidators(req *http.Request) {
+	if e.ETag != "" {
+		req.Header.Set("If-None-Match", e.ETag)
+	}
+	if e.LastModified != "" {
+		req.Header.Set("If-Modified-Since", e.LastModified)
+	}
+}
+
+// load copies the cached content of e to w, checking it against the
+// recorded hash. A corrupt entry is removed and reported as
+// errCacheCorrupt.
+func (c *imageCache) load(e *cacheEntry, w io.Writer) error {
+	dataPath, entryPath := c.paths(e.Key)
+	f, err := os.Open(dataPath)
+	if err != nil {
+		return errCacheCorrupt
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != e.SHA256 {
+		os.Remove(dataPath)
+		os.Remove(entryPath)
+		return errCacheCorrupt
+	}
+	// The modification time tracks use, for eviction.
+	now := time.Now()
+	os.Chtimes(dataPath, now, now)
+	return nil
+}
+
+// store calls write with a writer that also saves everything written as
+// the cached content of key, downloaded from uri, along with the
+// validators in header. The entry is only kept if write succeeds, and
+// failing to write the cache does not fail write.
+func (c *imageCache) store(key, uri string, header http.Header, write func(io.Writer) error) error {
+	if c == nil {
+		return write(io.Discard)
+	}
+	tmp, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		return write(io.Discard)
+	}
+	defer os.Remove(tmp.Name())
+
+	cw := &cacheWriter{w: tmp, h: sha256.New()}
+	err = write(cw)
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if cw.err != nil || closeErr != nil {
+		return nil
+	}
+
+	e := cacheEntry{
+		Key:          key,
+		URI:          uri,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		SHA256:       hex.EncodeToString(cw.h.Sum(nil)),
+		Size:         cw.n,
+	}
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return nil
+	}
+	dataPath, entryPath := c.paths(key)
+	if os.Rename(tmp.Name(), dataPath) == nil {
+		writeFileAtomic(entryPath, raw, 0600)
+	}
+	return nil
+}
+
+// cacheWriter writes to the cache on the side: an error stops further
+// writes to it but is not passed on.
+type cacheWriter struct {
+	w   io.Writer
+	h   hash.Hash
+	n   int64
+	err error
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+		w.h.Write(p)
+		w.n += int64(len(p))
+	}
+	return len(p), nil
+}
+
+// cachedFile is a cached image found while evicting.
+type cachedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// evict removes the least recently used entries until the cache fits its
+// size limit.
+func (c *imageCache) evict() {
+	if c == nil || c.maxSize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files, total, err := c.files()
+	if err != nil || total <= c.maxSize {
+		return
+	}
+	slices.SortFunc(files, func(a, b cachedFile) int { return a.modTime.Compare(b.modTime) })
+	for _, f := range files {
+		if total <= c.maxSize {
+			break
+		}
+		os.Remove(f.path)
+		os.Remove(f.path + ".json")
+		total -= f.size
+	}
+}
+
+// files lists the cached images and their total size.
+func (c *imageCache) files() ([]cachedFile, int64, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var files []cachedFile
+	var total int64
+	for _, de := range entries {
+		name := de.Name()
+		if de.IsDir() || strings.HasSuffix(name, ".json") || strings.HasPrefix(name, ".tmp-") {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, cachedFile{path: filepath.Join(c.dir, name), size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+	return files, total, nil
+}
+
+// runCache implements "gdoc2md cache clear".
+func runCache(args []string) error {
+	if len(args) != 1 || args[0] != "clear" {
+		return fmt.Errorf("usage: gdoc2md cache clear")
+	}
+	dir, err := imageCacheDir()
+	if err != nil {
+		return err
+	}
+	c := &imageCache{dir: dir}
+	files, total, err := c.files()
+	if os.IsNotExist(err) {
+		fmt.Println("The image cache is empty.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read image cache: %w", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to clear image cache: %w", err)
+	}
+	fmt.Printf("Removed %d cached image(s), %s, from %s\n", len(files), formatSize(total), dir)
+	return nil
+}
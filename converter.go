@@ -11,6 +11,28 @@ import (
 type ConvertResult struct {
 	Markdown string
 	Images   []ImageRef
+	Headings []Heading
+}
+
+// Heading records a heading written to the markdown output, in order.
+type Heading struct {
+	Level int
+	Text  string
+}
+
+// ConvertOptions adjusts how a tab is rendered.
+type ConvertOptions struct {
+	// HeadingOffset demotes every heading by this many levels (capped at 6).
+	HeadingOffset int
+
+	// ImagePrefix is prepended to image filenames in links, e.g. "images/"
+	// or "../images/" for files written into a subdirectory.
+	ImagePrefix string
+
+	// MissingImages holds the filenames of images that could not be
+	// downloaded; they are rendered as a visible placeholder instead of a
+	// broken link.
+	MissingImages map[string]bool
 }
 
 // ImageRef represents an image to download.
@@ -18,14 +40,30 @@ type ImageRef struct {
 	ObjectID   string
 	ContentURI string
 	Filename   string
+	// Alt and Link are the alt text and target of the image reference in
+	// the Markdown, see Markdown.
+	Alt  string
+	Link string
+}
+
+// missingImage is the placeholder written instead of a reference to an
+// image that could not be downloaded.
+func missingImage(img ImageRef) string {
+	return fmt.Sprintf("**[Image unavailable: %s]**", img.Alt)
+}
+
+// Markdown returns the image reference as written into the tab's Markdown.
+func (r ImageRef) Markdown() string {
+	return fmt.Sprintf("![%s](%s)", r.Alt, r.Link)
 }
 
 // ConvertTab converts a single Google Docs tab to markdown.
 // tabIndex is used to create globally unique image filenames across tabs.
-func ConvertTab(tab *docsv1.Tab, tabTitle string, tabIndex int) ConvertResult {
+func ConvertTab(tab *docsv1.Tab, tabTitle string, tabIndex int, opts ConvertOptions) ConvertResult {
 	c := &converter{
 		tab:      tab,
 		tabIndex: tabIndex,
+		opts:     opts,
 	}
 	c.writeHeading(tabTitle, 1)
 	if tab.DocumentTab != nil {
@@ -34,12 +72,15 @@ func ConvertTab(tab *docsv1.Tab, tabTitle string, tabIndex int) ConvertResult {
 	return ConvertResult{
 		Markdown: c.buf.String(),
 		Images:   c.images,
+		Headings: c.headings,
 	}
 }
 
 type converter struct {
 	tab        *docsv1.Tab
 	tabIndex   int
+	opts       ConvertOptions
+	headings   []Heading
 	buf        strings.Builder
 	images     []ImageRef
 	imageCount int
@@ -53,9 +94,12 @@ type listTracker struct {
 }
 
 func (c *converter) writeHeading(text string, level int) {
+	level = min(level+c.opts.HeadingOffset, 6)
+	text = strings.TrimSpace(text)
+	c.headings = append(c.headings, Heading{Level: level, Text: text})
 	c.buf.WriteString(strings.Repeat("#", level))
 	c.buf.WriteString(" ")
-	c.buf.WriteString(strings.TrimSpace(text))
+	c.buf.WriteString(text)
 	c.buf.WriteString("\n\n")
 }
 
@@ -259,13 +303,19 @@ func (c *converter) renderInlineObject(elem *docsv1.InlineObjectElement) string
 		alt = filename
 	}
 
-	c.images = append(c.images, ImageRef{
+	ref := ImageRef{
 		ObjectID:   elem.InlineObjectId,
 		ContentURI: embedded.ImageProperties.ContentUri,
 		Filename:   filename,
-	})
+		Alt:        alt,
+		Link:       c.opts.ImagePrefix + filename,
+	}
+	c.images = append(c.images, ref)
 
-	return fmt.Sprintf("![%s](images/%s)", alt, filename)
+	if c.opts.MissingImages[filename] {
+		return missingImage(ref)
+	}
+	return ref.Markdown()
 }
 
 func (c *converter) convertTable(table *docsv1.Table) {
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	docsv1 "google.golang.org/api/docs/v1"
+)
+
+func TestConvertTabMissingImageInTable(t *testing.T) {
+	image := &docsv1.Paragraph{Elements: []*docsv1.ParagraphElement{
+		{InlineObjectElement: &docsv1.InlineObjectElement{InlineObjectId: "kix.1"}},
+	}}
+	tab := &docsv1.Tab{DocumentTab: &docsv1.DocumentTab{
+		Body: &docsv1.Body{Content: []*docsv1.StructuralElement{{Table: &docsv1.Table{
+			TableRows: []*docsv1.TableRow{{TableCells: []*docsv1.TableCell{
+				{Content: []*docsv1.StructuralElement{{Paragraph: image}}},
+			}}},
+		}}}},
+		InlineObjects: map[string]docsv1.InlineObject{"kix.1": {
+			InlineObjectProperties: &docsv1.InlineObjectProperties{EmbeddedObject: &docsv1.EmbeddedObject{
+				Title:           "a|b",
+				ImageProperties: &docsv1.ImageProperties{ContentUri: "https://example.com/image.png"},
+			}},
+		}},
+	}}
+
+	opts := ConvertOptions{ImagePrefix: "images/"}
+	res := ConvertTab(tab, "Tab", 0, opts)
+	if len(res.Images) != 1 {
+		t.Fatalf("got %d images, want 1", len(res.Images))
+	}
+	if want := `![a\|b](images/tab0_image_001.png)`; !strings.Contains(res.Markdown, want) {
+		t.Errorf("Markdown does not contain %s:\n%s", want, res.Markdown)
+	}
+
+	opts.MissingImages = map[string]bool{res.Images[0].Filename: true}
+	res = ConvertTab(tab, "Tab", 0, opts)
+	if strings.Contains(res.Markdown, "](images/") {
+		t.Errorf("Markdown still links the missing image:\n%s", res.Markdown)
+	}
+	if want := `**[Image unavailable: a\|b]**`; !strings.Contains(res.Markdown, want) {
+		t.Errorf("Markdown does not contain %s:\n%s", want, res.Markdown)
+	}
+}
@@ -1,116 +1,549 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
-	docsv1 "google.golang.org/api/docs/v1"
 	"golang.org/x/sync/errgroup"
+	docsv1 "google.golang.org/api/docs/v1"
+	drive "google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
 )
 
+// ExportOptions controls how a document is written to the output directory.
+type ExportOptions struct {
+	// SingleFile concatenates all tabs into one markdown file named after the
+	// document instead of writing one file per tab plus tabs.md.
+	SingleFile bool
+
+	// Nested writes child tabs into a subdirectory named after their parent,
+	// with the parent's own content stored as NestedIndex inside it.
+	Nested      bool
+	NestedIndex string
+
+	// Filenames selects how tab titles become file and directory names.
+	Filenames filenamer
+
+	// Tabs and ExcludeTabs select which tabs to export by title, tab ID or
+	// glob pattern over the tab path (see selectTabs). Selecting or
+	// excluding a tab applies to its child tabs too.
+	Tabs        []string
+	ExcludeTabs []string
+
+	// Force rewrites every file and re-downloads every image even when the
+	// manifest from a previous export says they are unchanged.
+	Force bool
+
+	// Prune removes files the previous export wrote that the current one
+	// no longer produces. With DryRun they are only listed.
+	Prune  bool
+	DryRun bool
+
+	// ImageDir is the directory images are written to, relative to the
+	// output directory and slash-separated; "images" if empty. With
+	// ImagesPerTab each tab's images go into a subfolder of it named after
+	// the tab's file.
+	ImageDir     string
+	ImagesPerTab bool
+
+	// ImageURL, if set, replaces ImageDir at the start of image links, e.g.
+	// "/static/img/" for a site that serves ImageDir there. Otherwise links
+	// are relative to the Markdown file they appear in.
+	ImageURL string
+
+	// ImageStore, if set, receives the images instead of the output, and
+	// image links point at the uploaded objects.
+	ImageStore *bucketStore
+
+	// Strict fails the export, leaving the previous one in place, if any
+	// image cannot be downloaded. Otherwise the image's reference is
+	// replaced by a visible placeholder and the failure is reported.
+	Strict bool
+
+	// MaxImageSize is the largest image, in bytes, that is downloaded;
+	// larger ones fail like any other download. Zero means no limit.
+	MaxImageSize int64
+
+	// Concurrency bounds how many images are downloaded at once, across
+	// all documents of a run; 0 means defaultConcurrency.
+	Concurrency int
+
+	// SaveJSON, if set, is where the Docs API response is saved, fetched
+	// without the field mask so that it is complete.
+	SaveJSON string
+
+	// Stats fetches each document a second time without the field mask
+	// and reports how much the mask saves.
+	Stats bool
+
+	// Cache, if set, keeps downloaded images for later runs.
+	Cache *imageCache
+
+	// Failures, if set, collects every image download failure.
+	Failures *FailureReport
+
+	// Summary, if set, collects the report of every document exported.
+	Summary *RunSummary
+
+	// GitCommit commits the output directory to the git repository it is
+	// in after each export that changed something.
+	GitCommit bool
+}
+
+// fingerprint summarizes the options that affect what an export produces,
+// so a manifest written under different options is not trusted.
+func (o ExportOptions) fingerprint() string {
+	return fmt.Sprintf("single-file=%t nested=%t nested-index=%s filenames=%s tabs=%q exclude-tabs=%q image-dir=%s images-per-tab=%t image-url=%s image-store=%s",
+		o.SingleFile, o.Nested, o.nestedIndex(), o.Filenames, o.Tabs, o.ExcludeTabs, o.imageDir(), o.ImagesPerTab, o.ImageURL, o.ImageStore)
+}
+
 // tabResult holds the output of converting a single tab.
 type tabResult struct {
+	tab      *docsv1.Tab
+	index    int // position in the full tab tree, used for image filenames
+	id       string
+	parentID string
 	title    string
-	filename string
+	path     string // output path relative to the output directory, slash-separated
+	depth    int
+	convOpts ConvertOptions // what the tab was converted with
 	result   ConvertResult
+	elapsed  time.Duration // time taken by ConvertTab
+}
+
+// ExportReport describes the outcome of exporting one document. It is
+// also what --summary records for each document.
+type ExportReport struct {
+	DocID      string `json:"doc_id"`
+	Title      string `json:"title,omitempty"`
+	RevisionID string `json:"revision_id,omitempty"`
+	// Output is the output directory, archive or "-" for stdout.
+	Output string `json:"output"`
+	// Entry is the file readers should open first, relative to the output
+	// directory: tabs.md, or the combined file in single-file mode.
+	Entry string `json:"entry,omitempty"`
+	// Unchanged is set when the document had not changed since the
+	// previous export and nothing was written.
+	Unchanged bool `json:"unchanged"`
+	// Changed lists the titles of tabs whose file was written.
+	Changed []string `json:"changed_tabs"`
+	// Files lists every file the export produced, whether written or
+	// left unchanged, and Removed the stale files it pruned.
+	Files   []Artifact `json:"files"`
+	Removed []string   `json:"removed,omitempty"`
+	// ImageFailures lists the images that could not be downloaded.
+	ImageFailures []ImageFailure `json:"image_failures,omitempty"`
+	DurationMS    float64        `json:"duration_ms"`
+	// Fetch compares the document fetch with and without the field mask,
+	// with --stats.
+	Fetch *FetchStats `json:"fetch,omitempty"`
+	// Error is set if the export failed.
+	Error string `json:"error,omitempty"`
 }
 
 // ExportDoc fetches a Google Doc and exports all tabs as markdown files.
-func ExportDoc(ctx context.Context, client *http.Client, docID, outputDir string) error {
+func ExportDoc(ctx context.Context, client *http.Client, docID, outputDir string, opts ExportOptions) (*ExportReport, error) {
+	x, err := newExporter(ctx, client, opts.Concurrency)
+	if err != nil {
+		return nil, err
+	}
+	return x.export(ctx, docID, outputDir, opts)
+}
+
+// exporter holds what is shared between the documents exported in one
+// run: the authenticated client, the Docs and Drive services and the image
+// download pool.
+type exporter struct {
+	client *http.Client
+	srv    *docsv1.Service
+	drive  *drive.Service
+	pool   chan struct{}
+	// doc, if set, is exported instead of fetching the document, for
+	// convert. Nothing is fetched or downloaded then.
+	doc *docsv1.Document
+}
+
+// defaultConcurrency is how many images are downloaded at once unless -j
+// says otherwise.
+const defaultConcurrency = 10
+
+// newExporter creates an exporter that downloads up to concurrency images
+// at once (0 for defaultConcurrency).
+func newExporter(ctx context.Context, client *http.Client, concurrency int) (*exporter, error) {
 	srv, err := docsv1.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
-		return fmt.Errorf("failed to create Docs service: %w", err)
+		return nil, fmt.Errorf("failed to create Docs service: %w", err)
 	}
+	driveSrv, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Drive service: %w", err)
+	}
+	return &exporter{
+		client: client,
+		srv:    srv,
+		drive:  driveSrv,
+		pool:   make(chan struct{}, cmp.Or(concurrency, defaultConcurrency)),
+	}, nil
+}
 
-	fmt.Printf("Fetching document %s...\n", docID)
-	doc, err := srv.Documents.Get(docID).IncludeTabsContent(true).Do()
+// export writes one document into outputDir and, with opts.GitCommit,
+// commits the result.
+func (x *exporter) export(ctx context.Context, docID, outputDir string, opts ExportOptions) (*ExportReport, error) {
+	start := time.Now()
+	report, err := x.write(ctx, docID, outputDir, opts)
+	if err == nil && opts.GitCommit {
+		err = x.commitExport(ctx, outputDir, report)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to fetch document: %w", err)
+		logWarnEvent("export_failed", "doc_id", docID, "output", outputDir, "error", err.Error())
+		opts.Summary.add(&ExportReport{DocID: docID, Output: outputDir, Error: err.Error()})
+		return nil, err
+	}
+	report.Output = outputDir
+	report.DurationMS = ms(time.Since(start))
+	logEvent("export_done", "doc_id", docID, "output", outputDir, "revision_id", report.RevisionID,
+		"unchanged", report.Unchanged, "changed_tabs", len(report.Changed), "files", len(report.Files),
+		"image_failures", len(report.ImageFailures), "duration_ms", report.DurationMS)
+	opts.Summary.add(report)
+	return report, nil
+}
+
+// write exports one document into outputDir.
+func (x *exporter) write(ctx context.Context, docID, outputDir string, opts ExportOptions) (*ExportReport, error) {
+	srv := x.srv
+
+	// last is whatever the previous export into outputDir recorded; prev is
+	// the subset of it we may reuse to skip work.
+	last := loadManifest(outputDir)
+	var prev *Manifest
+	if !opts.Force && last != nil && last.DocID == docID {
+		prev = last
+	}
+
+	// A cheap revision check lets unchanged documents skip the full fetch,
+	// unless the response is to be saved.
+	if prev != nil && x.doc == nil && opts.SaveJSON == "" {
+		meta, err := srv.Documents.Get(docID).Fields("revisionId").Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch document revision: %w", err)
+		}
+		pendingPrune := opts.Prune && len(prev.Stale) > 0
+		if !pendingPrune && prev.upToDate(outputDir, meta.RevisionId, opts.fingerprint()) {
+			logf("Document %s is unchanged (revision %s), nothing to do.\n", docID, meta.RevisionId)
+			logEvent("unchanged", "doc_id", docID, "revision_id", meta.RevisionId)
+			return prev.report(outputDir), nil
+		}
+	}
+
+	doc, stats := x.doc, (*FetchStats)(nil)
+	if doc == nil {
+		var err error
+		if doc, stats, err = x.fetch(ctx, docID, opts); err != nil {
+			return nil, err
+		}
 	}
 
 	// Flatten tab tree.
 	tabs := flattenTabs(doc.Tabs)
 	if len(tabs) == 0 {
-		return fmt.Errorf("document has no tabs")
-	}
-	fmt.Printf("Found %d tab(s)\n", len(tabs))
-
-	// Ensure output and images directories exist.
-	imagesDir := filepath.Join(outputDir, "images")
-	if err := os.MkdirAll(imagesDir, 0755); err != nil {
-		return fmt.Errorf("failed to create images directory: %w", err)
+		return nil, fmt.Errorf("document has no tabs")
 	}
+	logf("Found %d tab(s)\n", len(tabs))
 
-	// Process tabs in parallel.
 	results := make([]tabResult, len(tabs))
-	g, _ := errgroup.WithContext(ctx)
 	for i, tab := range tabs {
-		i, tab := i, tab
+		results[i] = tabResult{
+			tab:      tab,
+			index:    i,
+			id:       tabID(tab),
+			parentID: tabParentID(tab),
+			title:    tabTitle(tab),
+			depth:    tabDepth(tab),
+		}
+	}
+	// Paths are assigned over the whole tree so that a tab keeps its
+	// filename no matter which other tabs are selected.
+	assignTabPaths(results, opts)
+
+	if len(opts.Tabs) > 0 || len(opts.ExcludeTabs) > 0 {
+		results = selectTabs(results, opts.Tabs, opts.ExcludeTabs)
+		if len(results) == 0 {
+			return nil, fmt.Errorf("no tabs match the selection")
+		}
+		logf("Selected %d tab(s)\n", len(results))
+	}
+
+	// Everything is written to a staging area first and only reaches the
+	// destination once the whole export has succeeded.
+	stage, err := newOutputSink(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			stage.Abort()
+		}
+	}()
+
+	// Only a single Markdown file can be streamed to stdout.
+	_, streaming := stage.(*streamSink)
+	if streaming && !opts.SingleFile && len(results) != 1 {
+		return nil, fmt.Errorf("writing to stdout needs --single-file or a single tab selected with --tab")
+	}
+	assets := opts.assetSink(stage, outputDir, doc.DocumentId)
+	// Images have nowhere to go on stdout unless they are uploaded, and
+	// convert does not download anything.
+	skipImages := (streaming && opts.ImageStore == nil) || x.doc != nil
+
+	// Process tabs in parallel; conversion is CPU-bound, so there is no
+	// point running more at once than there are CPUs.
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	for i := range results {
+		r := &results[i]
 		g.Go(func() error {
-			title := tabTitle(tab)
-			filename := sanitizeFilename(title) + ".md"
-			result := ConvertTab(tab, title, i)
-			results[i] = tabResult{
-				title:    title,
-				filename: filename,
-				result:   result,
+			if err := gctx.Err(); err != nil {
+				return err
+			}
+			// The combined file of single-file mode sits in the output
+			// directory itself.
+			mdPath := r.path
+			if opts.SingleFile {
+				mdPath = ""
+			}
+			r.convOpts = ConvertOptions{
+				ImagePrefix: opts.imageLinkPrefix(assets, mdPath, r.path),
 			}
+			if opts.SingleFile {
+				r.convOpts.HeadingOffset = r.depth
+			}
+			start := time.Now()
+			r.result = ConvertTab(r.tab, r.title, r.index, r.convOpts)
+			r.elapsed = time.Since(start)
 			return nil
 		})
 	}
 	if err := g.Wait(); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Print conversion results (after parallel work, to avoid interleaved output).
 	for _, r := range results {
-		fmt.Printf("  Converted: %s\n", r.title)
+		logf("  Converted: %s\n", r.title)
+		logEvent("tab_converted", "doc_id", docID, "tab", r.title, "tab_id", r.id,
+			"bytes", len(r.result.Markdown), "images", len(r.result.Images), "duration_ms", ms(r.elapsed))
 	}
 
-	// Collect all images from all tabs and download in parallel.
+	manifest := &Manifest{
+		DocID:      doc.DocumentId,
+		Title:      doc.Title,
+		RevisionID: doc.RevisionId,
+		Version:    version,
+		Options:    opts.fingerprint(),
+	}
+
+	// Collect all images from all tabs; those already on disk from the
+	// previous export are kept, the rest are downloaded in parallel.
 	var allImages []imageDownload
+	notStreamed := 0
 	for _, r := range results {
 		for _, img := range r.result.Images {
+			rel := opts.tabImageDir(r.path) + "/" + img.Filename
+			if skipImages {
+				notStreamed++
+				// Keep images from an earlier export tracked, so that
+				// pruning does not delete them.
+				if e, ok := last.lookup(rel); ok && assets.Has(ctx, e) {
+					manifest.Images = append(manifest.Images, e)
+				}
+				continue
+			}
+			if e, ok := prev.lookup(rel); ok && e.ID == img.ObjectID && assets.Has(ctx, e) {
+				manifest.Images = append(manifest.Images, e)
+				continue
+			}
 			allImages = append(allImages, imageDownload{
-				ref:       img,
-				imagesDir: imagesDir,
+				ref:   img,
+				docID: doc.DocumentId,
+				tab:   r.title,
+				tabID: r.id,
+				path:  rel,
 			})
 		}
 	}
+	if skipped := len(manifest.Images); skipped > 0 && !skipImages {
+		logf("Skipping %d unchanged image(s)\n", skipped)
+	}
+
+	// Without its images the export is not complete: the next export
+	// must not take it as up to date.
+	manifest.Incomplete = notStreamed > 0
+	switch {
+	case notStreamed > 0 && x.doc != nil:
+		logf("Not downloading %d image(s) when converting a saved document\n", notStreamed)
+	case notStreamed > 0:
+		warnf("not downloading %d image(s) when writing to stdout; their links will not resolve\n", notStreamed)
+	}
+	report := &ExportReport{
+		DocID:      doc.DocumentId,
+		Title:      doc.Title,
+		RevisionID: doc.RevisionId,
+		Fetch:      stats,
+	}
+	// wrote records which of the files in the manifest this export wrote.
+	wrote := make(map[string]bool)
 
 	if len(allImages) > 0 {
-		fmt.Printf("Downloading %d image(s)...\n", len(allImages))
-		if err := downloadImages(ctx, client, allImages); err != nil {
-			return err
+		logf("Downloading %d image(s)...\n", len(allImages))
+		if err := downloadImages(ctx, x.client, x.pool, allImages, assets, opts.Cache, opts.MaxImageSize); err != nil {
+			return nil, err
+		}
+		if n := countCached(allImages); n > 0 {
+			logf("Took %d image(s) from the cache\n", n)
+		}
+		missing := make(map[string]bool)
+		for _, img := range allImages {
+			if img.err == nil {
+				manifest.Images = append(manifest.Images, ManifestEntry{
+					ID:     img.ref.ObjectID,
+					Path:   img.path,
+					SHA256: img.sha256,
+					Size:   img.size,
+					URL:    assets.URL(img.path),
+				})
+				wrote[img.path] = true
+				logEvent("image_downloaded", "doc_id", docID, "tab", img.tab, "path", img.path,
+					"bytes", img.size, "cached", img.cached, "duration_ms", ms(img.elapsed))
+				continue
+			}
+			failure := newImageFailure(doc.DocumentId, img)
+			report.ImageFailures = append(report.ImageFailures, failure)
+			logWarnEvent("image_failed", "doc_id", docID, "tab", img.tab, "path", img.path, "uri", failure.URI,
+				"status", failure.Status, "error", failure.Error, "duration_ms", ms(img.elapsed))
+			if e, ok := last.lookup(img.path); ok && assets.Has(ctx, e) {
+				// Keep the previous copy of an image that failed to download
+				// tracked, so pruning does not delete it.
+				manifest.Images = append(manifest.Images, e)
+			} else {
+				missing[img.ref.Filename] = true
+			}
+		}
+		manifest.Incomplete = len(report.ImageFailures) > 0
+		opts.Failures.add(report.ImageFailures...)
+		if opts.Strict && len(report.ImageFailures) > 0 {
+			return nil, fmt.Errorf("%d image(s) could not be downloaded", len(report.ImageFailures))
+		}
+		// Convert tabs referring to images that are not on disk again,
+		// with a visible placeholder rather than a broken link.
+		for i := range results {
+			r := &results[i]
+			if slices.ContainsFunc(r.result.Images, func(img ImageRef) bool { return missing[img.Filename] }) {
+				r.convOpts.MissingImages = missing
+				r.result = ConvertTab(r.tab, r.title, r.index, r.convOpts)
+			}
 		}
 	}
 
-	// Write markdown files.
-	for _, r := range results {
-		outPath := filepath.Join(outputDir, r.filename)
-		if err := os.WriteFile(outPath, []byte(r.result.Markdown), 0644); err != nil {
-			return fmt.Errorf("failed to write %s: %w", outPath, err)
+	// Write markdown files, leaving untouched those whose content is unchanged.
+	if opts.SingleFile {
+		name := opts.Filenames.name(nameData{Title: doc.Title, ID: doc.DocumentId})
+		e, written, err := writeOutput(stage, outputDir, name+".md", []byte(renderSingleFile(results)), prev)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, e)
+		report.Entry = e.Path
+		if written {
+			wrote[e.Path] = true
+			for _, r := range results {
+				report.Changed = append(report.Changed, r.title)
+			}
+		}
+	} else {
+		for _, r := range results {
+			e, written, err := writeOutput(stage, outputDir, r.path, []byte(r.result.Markdown), prev)
+			if err != nil {
+				return nil, err
+			}
+			e.ID = r.id
+			manifest.Tabs = append(manifest.Tabs, e)
+			if written {
+				wrote[e.Path] = true
+				report.Changed = append(report.Changed, r.title)
+			}
+		}
+		if !streaming {
+			e, written, err := writeOutput(stage, outputDir, "tabs.md", []byte(generateIndex(results)), prev)
+			if err != nil {
+				return nil, err
+			}
+			wrote[e.Path] = written
+			manifest.Files = append(manifest.Files, e)
+			report.Entry = e.Path
 		}
-		fmt.Printf("  Wrote: %s\n", outPath)
 	}
 
-	// Write tabs.md index file.
-	indexPath := filepath.Join(outputDir, "tabs.md")
-	index := generateIndex(results)
-	if err := os.WriteFile(indexPath, []byte(index), 0644); err != nil {
-		return fmt.Errorf("failed to write tabs.md: %w", err)
+	stale := pruneStale(outputDir, last, manifest, opts.Prune, opts.DryRun)
+	for _, rel := range stale {
+		stage.Remove(rel)
+	}
+	if isDirOutput(outputDir) {
+		if err := saveManifest(stage, manifest); err != nil {
+			return nil, err
+		}
 	}
-	fmt.Printf("  Wrote: %s\n", indexPath)
 
-	fmt.Println("Done!")
-	return nil
+	// Don't move a half-finished export into place after an interrupt.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	committed = true
+	if err := stage.Commit(); err != nil {
+		return nil, err
+	}
+	for _, rel := range stale {
+		logf("  Removed: %s\n", filepath.Join(outputDir, filepath.FromSlash(rel)))
+		logEvent("file_removed", "path", rel, "output", outputDir)
+	}
+	report.Files = manifest.artifacts(outputDir, wrote)
+	report.Removed = stale
+
+	logf("Done!\n")
+	return report, nil
+}
+
+// writeOutput stages data as the slash-separated path rel, unless the
+// previous export recorded identical content that is still in outputDir.
+// It returns the manifest entry for the file and whether it was written.
+func writeOutput(stage outputSink, outputDir, rel string, data []byte, prev *Manifest) (e ManifestEntry, written bool, err error) {
+	e = ManifestEntry{Path: rel, SHA256: hashBytes(data), Size: int64(len(data))}
+	outPath := filepath.Join(outputDir, filepath.FromSlash(rel))
+	if old, ok := prev.lookup(rel); ok && old.SHA256 == e.SHA256 && fileMatches(outputDir, e) {
+		logf("  Unchanged: %s\n", outPath)
+		logEvent("file_unchanged", "path", rel, "output", outputDir, "bytes", e.Size)
+		return e, false, nil
+	}
+
+	start := time.Now()
+	if err := stage.WriteFile(rel, data); err != nil {
+		return e, false, fmt.Errorf("failed to write %s: %w", outPath, err)
+	}
+	logf("  Wrote: %s\n", outPath)
+	logEvent("file_written", "path", rel, "output", outputDir, "bytes", e.Size, "duration_ms", ms(time.Since(start)))
+	return e, true, nil
 }
 
 func flattenTabs(tabs []*docsv1.Tab) []*docsv1.Tab {
@@ -129,44 +562,73 @@ func tabTitle(tab *docsv1.Tab) string {
 	return "Untitled"
 }
 
-func sanitizeFilename(name string) string {
-	replacer := strings.NewReplacer(
-		"/", "-",
-		"\\", "-",
-		":", "-",
-		"*", "",
-		"?", "",
-		"\"", "",
-		"<", "",
-		">", "",
-		"|", "",
-	)
-	name = replacer.Replace(name)
-	name = strings.TrimSpace(name)
-	if name == "" {
-		return "untitled"
+// tabDepth returns how deeply a tab is nested; top-level tabs are 0.
+func tabDepth(tab *docsv1.Tab) int {
+	if tab.TabProperties == nil {
+		return 0
 	}
-	return name
+	return int(tab.TabProperties.NestingLevel)
+}
+
+func tabID(tab *docsv1.Tab) string {
+	if tab.TabProperties == nil {
+		return ""
+	}
+	return tab.TabProperties.TabId
+}
+
+func tabParentID(tab *docsv1.Tab) string {
+	if tab.TabProperties == nil {
+		return ""
+	}
+	return tab.TabProperties.ParentTabId
 }
 
 type imageDownload struct {
-	ref       ImageRef
-	imagesDir string
+	ref     ImageRef
+	docID   string
+	tab     string // title of the tab the image is in
+	tabID   string
+	path    string // relative to the output directory, slash-separated
+	sha256  string // set once downloaded successfully
+	size    int64
+	err     error // set if the download failed
+	cached  bool  // set if the image came from the image cache
+	elapsed time.Duration
+}
+
+// httpStatusError is returned for a response with an unexpected status.
+type httpStatusError struct {
+	StatusCode int
 }
 
-func downloadImages(ctx context.Context, client *http.Client, images []imageDownload) error {
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d", e.StatusCode)
+}
+
+// downloadImages fetches images in parallel into assets, at most cap(sem)
+// at a time and each at most maxSize bytes (0 for no limit), taking those
+// it can from cache. It records the content hash of each one that succeeds
+// and the error of each one that fails. Failed downloads are reported as
+// warnings.
+func downloadImages(ctx context.Context, client *http.Client, sem chan struct{}, images []imageDownload, assets assetSink, cache *imageCache, maxSize int64) error {
 	g, gctx := errgroup.WithContext(ctx)
-	sem := make(chan struct{}, 10)
 	var mu sync.Mutex
 	var warnings []string
 
-	for _, img := range images {
-		img := img
+	for i := range images {
+		img := &images[i]
 		g.Go(func() error {
 			sem <- struct{}{}
 			defer func() { <-sem }()
 
-			if err := downloadImage(gctx, client, img.ref.ContentURI, filepath.Join(img.imagesDir, img.ref.Filename)); err != nil {
+			start := time.Now()
+			err := downloadImage(gctx, client, cache, img, maxSize, func(write func(io.Writer) error) error {
+				return assets.Put(gctx, img.path, write)
+			})
+			img.elapsed = time.Since(start)
+			if err != nil {
+				img.err = err
 				mu.Lock()
 				warnings = append(warnings, fmt.Sprintf("%s: %v", img.ref.Filename, err))
 				mu.Unlock()
@@ -177,47 +639,130 @@ func downloadImages(ctx context.Context, client *http.Client, images []imageDown
 	if err := g.Wait(); err != nil {
 		return err
 	}
+	cache.evict()
+	// Downloads cut short by an interrupt are not worth reporting.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if len(warnings) > 0 {
-		fmt.Printf("Warning: failed to download %d image(s):\n", len(warnings))
-		for _, w := range warnings {
-			fmt.Printf("  - %s\n", w)
-		}
+		warnf("failed to download %d image(s):\n  - %s\n", len(warnings), strings.Join(warnings, "\n  - "))
 	}
 	return nil
 }
 
-func downloadImage(ctx context.Context, client *http.Client, uri, destPath string) error {
+// downloadImage fetches img, or takes it from cache if the cached copy is
+// still current, hands the content to put to store, and records its
+// SHA-256 and size in img.
+func downloadImage(ctx context.Context, client *http.Client, cache *imageCache, img *imageDownload, maxSize int64, put func(write func(io.Writer) error) error) error {
+	uri, key := img.ref.ContentURI, imageCacheKey(img.docID, img.ref)
+	cached := cache.lookup(key)
+	if cached != nil && maxSize > 0 && cached.Size > maxSize {
+		// Let the server tell whether the image is still too large.
+		cached = nil
+	}
+	if cached != nil && !cached.revalidate() {
+		err := img.fromCache(cache, cached, put)
+		if !errors.Is(err, errCacheCorrupt) {
+			return err
+		}
+		cached = nil
+	}
+
 	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
 	if err != nil {
 		return err
 	}
+	if cached != nil {
+		cached.setValidators(req)
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		err := img.fromCache(cache, cached, put)
+		if !errors.Is(err, errCacheCorrupt) {
+			return err
+		}
+		// The cached copy went bad since it was looked up; fetch it anew.
+		return downloadImage(ctx, client, nil, img, maxSize, put)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
+		return &httpStatusError{StatusCode: resp.StatusCode}
+	}
+
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		return fmt.Errorf("image is %s, over the %s limit", formatSize(resp.ContentLength), formatSize(maxSize))
 	}
 
-	f, err := os.Create(destPath)
+	// Without a Content-Length the size is only known while reading, so
+	// read one byte past the limit to tell a complete image from a
+	// truncated one.
+	var body io.Reader = resp.Body
+	if maxSize > 0 {
+		body = io.LimitReader(resp.Body, maxSize+1)
+	}
+	h := sha256.New()
+	var n int64
+	err = put(func(w io.Writer) error {
+		return cache.store(key, uri, resp.Header, func(cw io.Writer) error {
+			var err error
+			n, err = io.Copy(io.MultiWriter(w, cw, h), body)
+			if err == nil && maxSize > 0 && n > maxSize {
+				err = fmt.Errorf("image is larger than the %s limit", formatSize(maxSize))
+			}
+			return err
+		})
+	})
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	img.sha256, img.size = hex.EncodeToString(h.Sum(nil)), n
+	return nil
+}
+
+func countCached(images []imageDownload) int {
+	n := 0
+	for _, img := range images {
+		if img.cached {
+			n++
+		}
+	}
+	return n
+}
 
-	const maxImageSize = 50 << 20 // 50 MB
-	_, err = io.Copy(f, io.LimitReader(resp.Body, maxImageSize))
-	return err
+// fromCache stores the cached copy e of the image through put.
+func (img *imageDownload) fromCache(cache *imageCache, e *cacheEntry, put func(write func(io.Writer) error) error) error {
+	err := put(func(w io.Writer) error {
+		return cache.load(e, w)
+	})
+	if err != nil {
+		return err
+	}
+	img.sha256, img.size, img.cached = e.SHA256, e.Size, true
+	return nil
 }
 
 func generateIndex(results []tabResult) string {
 	var sb strings.Builder
 	sb.WriteString("# Table of Contents\n\n")
 	for _, r := range results {
-		sb.WriteString(fmt.Sprintf("- [%s](%s)\n", r.title, r.filename))
+		indent := strings.Repeat("  ", r.depth)
+		sb.WriteString(fmt.Sprintf("%s- [%s](%s)\n", indent, r.title, linkTarget(r.path)))
 	}
 	sb.WriteString("\n")
 	return sb.String()
 }
+
+// formatSize formats a byte count for messages, e.g. "50 MB".
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.4g MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.4g KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
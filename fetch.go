@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	docsv1 "google.golang.org/api/docs/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// maxTabNesting is how deeply Google Docs nests tabs: a top-level tab and
+// up to two levels of child tabs. One level more is requested in case
+// that ever grows.
+const maxTabNesting = 4
+
+// documentFields returns the partial-response field mask for the full
+// document fetch. It asks for what the export uses and nothing more: the
+// document's identity, the tab tree, and for each tab the fields read by
+// the converter features below. Named styles, suggestions, headers,
+// footers, positioned objects and most per-run styling are left out,
+// which shrinks the response of a large, heavily styled document a lot.
+//
+// The mask is the same for every export: no option turns a converter
+// feature off, and images are linked even when they are not downloaded,
+// so their inline objects are always needed.
+func documentFields() googleapi.Field {
+	// Inline formatting: bold, italic, strikethrough, links and
+	// monospace fonts rendered as code.
+	textStyle := "textStyle(bold,italic,strikethrough,link(url),weightedFontFamily(fontFamily))"
+	elements := "elements(" + strings.Join([]string{
+		"textRun(content," + textStyle + ")",
+		// Images, resolved through the tab's inlineObjects.
+		"inlineObjectElement(inlineObjectId)",
+		"horizontalRule",
+	}, ",") + ")"
+	paragraph := "paragraph(" + strings.Join([]string{
+		elements,
+		// Headings.
+		"paragraphStyle(namedStyleType)",
+		// Lists, resolved through the tab's lists.
+		"bullet(listId,nestingLevel)",
+	}, ",") + ")"
+	// Tables; only paragraphs inside cells are rendered.
+	table := "table(tableRows(tableCells(content(" + paragraph + "))))"
+	documentTab := "documentTab(" + strings.Join([]string{
+		"body(content(" + paragraph + "," + table + "))",
+		"lists",
+		"inlineObjects",
+	}, ",") + ")"
+
+	tab := ""
+	for range maxTabNesting {
+		fields := "tabProperties(tabId,title,parentTabId,nestingLevel)," + documentTab
+		if tab != "" {
+			fields += ",childTabs(" + tab + ")"
+		}
+		tab = fields
+	}
+	return googleapi.Field("documentId,title,revisionId,tabs(" + tab + ")")
+}
+
+// fetch downloads the document to export: with the field mask, unless
+// opts.SaveJSON asks for the complete response to be saved.
+func (x *exporter) fetch(ctx context.Context, docID string, opts ExportOptions) (*docsv1.Document, *FetchStats, error) {
+	logf("Fetching document %s...\n", docID)
+	start := time.Now()
+	var (
+		doc, full *docsv1.Document
+		stats     *FetchStats
+		err       error
+	)
+	switch {
+	case opts.Stats:
+		doc, full, stats, err = x.fetchWithStats(ctx, docID)
+	case opts.SaveJSON != "":
+		full, err = x.srv.Documents.Get(docID).IncludeTabsContent(true).Context(ctx).Do()
+		doc = full
+	default:
+		doc, err = x.srv.Documents.Get(docID).IncludeTabsContent(true).Fields(documentFields()).Context(ctx).Do()
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch document: %w", err)
+	}
+	logEvent("fetch", "doc_id", docID, "revision_id", doc.RevisionId, "title", doc.Title,
+		"duration_ms", ms(time.Since(start)))
+
+	if opts.SaveJSON != "" {
+		if err := saveDocJSON(opts.SaveJSON, full); err != nil {
+			return nil, nil, err
+		}
+	}
+	return doc, stats, nil
+}
+
+// saveDocJSON writes a Docs API response for gdoc2md convert.
+func saveDocJSON(path string, doc *docsv1.Document) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	logf("  Saved: %s\n", path)
+	logEvent("document_saved", "doc_id", doc.DocumentId, "path", path, "bytes", len(data)+1)
+	return nil
+}
+
+// loadDocJSON reads a document saved with --save-json.
+func loadDocJSON(path string) (*docsv1.Document, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc docsv1.Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if doc.DocumentId == "" || len(doc.Tabs) == 0 {
+		return nil, fmt.Errorf("%s is not a document saved with --save-json (no document ID or tabs)", path)
+	}
+	return &doc, nil
+}
+
+// runConvert exports a document saved with --save-json without contacting
+// Google, for reproducing conversion problems offline. Images are linked
+// as usual but not downloaded.
+func runConvert(ctx context.Context, path, outputDir string, opts ExportOptions) error {
+	doc, err := loadDocJSON(path)
+	if err != nil {
+		return err
+	}
+	x := &exporter{doc: doc, pool: make(chan struct{}, 1)}
+	_, err = x.export(ctx, doc.DocumentId, outputDir, opts)
+	return err
+}
+
+// FetchStats compares the document fetch with and without the field mask,
+// for --stats. Bytes are counted after decompression.
+type FetchStats struct {
+	MaskedBytes int64   `json:"masked_bytes"`
+	MaskedMS    float64 `json:"masked_ms"`
+	FullBytes   int64   `json:"full_bytes"`
+	FullMS      float64 `json:"full_ms"`
+	// Identical is false if the two responses convert to different
+	// Markdown, which means the field mask leaves out something the
+	// converter uses.
+	Identical bool `json:"identical"`
+}
+
+// fetchWithStats fetches the document with the field mask and again
+// without it, measuring both, and returns both documents.
+func (x *exporter) fetchWithStats(ctx context.Context, docID string) (doc, full *docsv1.Document, stats *FetchStats, err error) {
+	counter := &countingTransport{base: x.client.Transport}
+	srv, err := docsv1.NewService(ctx, option.WithHTTPClient(&http.Client{Transport: counter}))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	fetch := func(fields ...googleapi.Field) (*docsv1.Document, int64, time.Duration, error) {
+		counter.n.Store(0)
+		start := time.Now()
+		call := srv.Documents.Get(docID).IncludeTabsContent(true).Context(ctx)
+		if len(fields) > 0 {
+			call = call.Fields(fields...)
+		}
+		doc, err := call.Do()
+		return doc, counter.n.Load(), time.Since(start), err
+	}
+
+	doc, maskedBytes, maskedTime, err := fetch(documentFields())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	full, fullBytes, fullTime, err := fetch()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("without field mask: %w", err)
+	}
+	stats = &FetchStats{
+		MaskedBytes: maskedBytes,
+		MaskedMS:    ms(maskedTime),
+		FullBytes:   fullBytes,
+		FullMS:      ms(fullTime),
+		Identical:   sameMarkdown(doc, full),
+	}
+
+	logf("Fetch with field mask:    %s in %s\n", formatSize(maskedBytes), maskedTime.Round(time.Millisecond))
+	logf("Fetch without field mask: %s in %s\n", formatSize(fullBytes), fullTime.Round(time.Millisecond))
+	if fullBytes > 0 && fullTime > 0 {
+		logf("With the field mask, the payload is %.0f%% and the fetch time %.0f%% of the full fetch\n",
+			100*float64(maskedBytes)/float64(fullBytes), 100*maskedTime.Seconds()/fullTime.Seconds())
+	}
+	logEvent("fetch_stats", "doc_id", docID, "masked_bytes", maskedBytes, "masked_ms", stats.MaskedMS,
+		"full_bytes", fullBytes, "full_ms", stats.FullMS, "identical", stats.Identical)
+	if !stats.Identical {
+		warnf("the field mask changes the converted Markdown of %s; please report this\n", docID)
+	}
+	return doc, full, stats, nil
+}
+
+// sameMarkdown reports whether every tab of a and b converts to the same
+// Markdown.
+func sameMarkdown(a, b *docsv1.Document) bool {
+	ta, tb := flattenTabs(a.Tabs), flattenTabs(b.Tabs)
+	if len(ta) != len(tb) {
+		return false
+	}
+	for i := range ta {
+		ra := ConvertTab(ta[i], tabTitle(ta[i]), i, ConvertOptions{})
+		rb := ConvertTab(tb[i], tabTitle(tb[i]), i, ConvertOptions{})
+		if ra.Markdown != rb.Markdown {
+			return false
+		}
+	}
+	return true
+}
+
+// countingTransport counts the response body bytes read through it.
+type countingTransport struct {
+	base http.RoundTripper
+	n    atomic.Int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, n: &t.n}
+	return resp, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestConvertGolden converts a document saved with --save-json and
+// compares the output with testdata/handbook/<case>. Run
+// "go test -run TestConvertGolden -update" to accept changed output.
+func TestConvertGolden(t *testing.T) {
+	quiet = true
+	t.Cleanup(func() { quiet = false })
+
+	for _, tc := range []struct {
+		name string
+		opts ExportOptions
+	}{
+		{"tabs", ExportOptions{}},
+		{"single-file", ExportOptions{SingleFile: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := t.TempDir()
+			if err := runConvert(context.Background(), filepath.Join("testdata", "handbook.json"), out, tc.opts); err != nil {
+				t.Fatal(err)
+			}
+			got := readTree(t, out)
+			golden := filepath.Join("testdata", "handbook", tc.name)
+			if *update {
+				if err := os.RemoveAll(golden); err != nil {
+					t.Fatal(err)
+				}
+				for rel, data := range got {
+					p := filepath.Join(golden, filepath.FromSlash(rel))
+					if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return
+			}
+
+			want := readTree(t, golden)
+			if g, w := slices.Sorted(maps.Keys(got)), slices.Sorted(maps.Keys(want)); !slices.Equal(g, w) {
+				t.Fatalf("files = %q, want %q", g, w)
+			}
+			for rel, data := range want {
+				if got[rel] != data {
+					t.Errorf("%s differs from the golden file:\n--- got ---\n%s\n--- want ---\n%s", rel, got[rel], data)
+				}
+			}
+		})
+	}
+}
+
+// readTree returns the contents of the files under dir by slash-separated
+// relative path, leaving out the manifest, which records the version.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == manifestFile {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
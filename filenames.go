@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxNameBytes bounds a single path component. Most filesystems allow 255
+// bytes; staying well below leaves room for disambiguation suffixes, the
+// extension and deep output directories on Windows.
+const maxNameBytes = 120
+
+// nameData is what a filename strategy can draw on.
+type nameData struct {
+	Title string // tab (or document) title
+	ID    string // tab (or document) ID
+	Index int    // position in tree order
+	Depth int    // nesting level, 0 for top-level tabs
+}
+
+// Slug exposes slugify to filename templates as {{.Slug}}.
+func (d nameData) Slug() string { return slugify(d.Title) }
+
+// filenamer turns tabs into file and directory names according to the
+// strategy selected with --filenames: "title" (the default), "slug", "id",
+// or a Go template such as "{{.Index}}-{{.Slug}}". The zero value uses titles.
+type filenamer struct {
+	strategy string
+	tmpl     *template.Template
+}
+
+func newFilenamer(spec string) (filenamer, error) {
+	switch spec {
+	case "", "title", "slug", "id":
+		return filenamer{strategy: spec}, nil
+	}
+	if !strings.Contains(spec, "{{") {
+		return filenamer{}, fmt.Errorf("unknown filename strategy %q (want title, slug, id or a template)", spec)
+	}
+	tmpl, err := template.New("filename").Option("missingkey=error").Parse(spec)
+	if err != nil {
+		return filenamer{}, fmt.Errorf("invalid filename template: %w", err)
+	}
+	f := filenamer{strategy: spec, tmpl: tmpl}
+	// Catch references to unknown fields now rather than mid-export.
+	if _, err := f.render(nameData{Title: "Title", ID: "t.0"}); err != nil {
+		return filenamer{}, fmt.Errorf("invalid filename template: %w", err)
+	}
+	return f, nil
+}
+
+// name returns a safe file or directory name, without extension, for d.
+func (f filenamer) name(d nameData) string {
+	if f.tmpl != nil {
+		s, err := f.render(d)
+		if err != nil {
+			return sanitizeFilename(d.Title)
+		}
+		return safeFilename(s)
+	}
+	switch f.strategy {
+	case "slug":
+		if s := slugify(d.Title); s != "" {
+			return safeFilename(s)
+		}
+		return safeFilename(d.ID)
+	case "id":
+		return safeFilename(d.ID)
+	default:
+		return sanitizeFilename(d.Title)
+	}
+}
+
+// String returns the strategy as given to --filenames.
+func (f filenamer) String() string {
+	if f.strategy == "" {
+		return "title"
+	}
+	return f.strategy
+}
+
+func (f filenamer) render(d nameData) (string, error) {
+	var sb strings.Builder
+	if err := f.tmpl.Execute(&sb, d); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// join combines a parent name and a child name, used to disambiguate
+// tabs that share a title.
+func (f filenamer) join(parent, name string) string {
+	if f.strategy == "slug" {
+		return safeFilename(parent + "-" + name)
+	}
+	return safeFilename(parent + " - " + name)
+}
+
+// suffix appends a distinguishing value (a tab ID or a counter) to name.
+// name is shortened first if need be, so that the suffix survives the
+// length limit and names differing only in it stay distinct.
+func (f filenamer) suffix(name, s string) string {
+	if f.strategy == "slug" {
+		s = "-" + slugify(s)
+	} else {
+		s = " (" + s + ")"
+	}
+	return safeFilename(truncateTo(name, maxNameBytes-len(s)) + s)
+}
+
+// sanitizeFilename makes a title usable as a filename while keeping it
+// readable: path separators and characters Windows rejects are dropped.
+func sanitizeFilename(name string) string {
+	replacer := strings.NewReplacer(
+		"/", "-",
+		"\\", "-",
+		":", "-",
+		"*", "",
+		"?", "",
+		"\"", "",
+		"<", "",
+		">", "",
+		"|", "",
+	)
+	return safeFilename(replacer.Replace(name))
+}
+
+// windowsReserved are device names Windows refuses as a filename, with or
+// without an extension.
+var windowsReserved = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true,
+	"com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true,
+	"lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// safeFilename applies the rules every strategy must satisfy to produce a
+// name valid on Linux, macOS and Windows: no separators or control
+// characters, no leading or trailing dots and spaces, no reserved device
+// names, and a bounded length.
+func safeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '-'
+		case unicode.IsControl(r), strings.ContainsRune(`:*?"<>|`, r):
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	if name == "" {
+		return "untitled"
+	}
+	base, _, _ := strings.Cut(name, ".")
+	if windowsReserved[strings.ToLower(strings.TrimSpace(base))] {
+		name = "_" + name
+	}
+	return truncateName(name)
+}
+
+// truncateName cuts name to maxNameBytes without splitting a UTF-8 sequence.
+func truncateName(name string) string {
+	return truncateTo(name, maxNameBytes)
+}
+
+// truncateTo cuts name to at most n bytes without splitting a UTF-8
+// sequence.
+func truncateTo(name string, n int) string {
+	if len(name) <= n {
+		return name
+	}
+	cut := max(n, 0)
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return strings.TrimRight(name[:cut], " .-")
+}
+
+// transliterations covers letters that do not decompose into an ASCII base
+// letter plus combining marks.
+var transliterations = strings.NewReplacer(
+	"ß", "ss", "æ", "ae", "Æ", "ae", "œ", "oe", "Œ", "oe",
+	"ø", "o", "Ø", "o", "ł", "l", "Ł", "l", "đ", "d", "Đ", "d",
+	"þ", "th", "Þ", "th", "ð", "d", "Ð", "d", "ı", "i",
+	"&", " and ",
+)
+
+// slugify returns a lowercase ASCII slug: accents are stripped, a few
+// letters are transliterated, and every other run of characters becomes a
+// single hyphen. It returns "" if nothing transliterable remains.
+func slugify(s string) string {
+	s = transliterations.Replace(s)
+	t := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)))
+	if out, _, err := transform.String(t, s); err == nil {
+		s = out
+	}
+
+	var sb strings.Builder
+	pendingHyphen := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if pendingHyphen && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			pendingHyphen = false
+			sb.WriteRune(r)
+			continue
+		}
+		pendingHyphen = true
+	}
+	return sb.String()
+}
+
+// linkTarget escapes a relative path for use as a markdown link target.
+// Only characters that would break the link are encoded, so non-ASCII
+// names stay readable in the source.
+func linkTarget(p string) string {
+	return linkEscaper.Replace(p)
+}
+
+var linkEscaper = strings.NewReplacer(
+	"%", "%25",
+	" ", "%20",
+	"(", "%28",
+	")", "%29",
+	"<", "%3C",
+	">", "%3E",
+	"#", "%23",
+	"?", "%3F",
+)
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	drive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	mimeDocument = "application/vnd.google-apps.document"
+	mimeFolder   = "application/vnd.google-apps.folder"
+	mimeShortcut = "application/vnd.google-apps.shortcut"
+)
+
+// parseFolderURL parses a Google Drive folder URL and returns the folder ID.
+// Supports formats:
+//   - https://drive.google.com/drive/folders/FOLDER_ID
+//   - https://drive.google.com/drive/u/0/folders/FOLDER_ID?usp=sharing
+//   - https://drive.google.com/open?id=FOLDER_ID
+//   - FOLDER_ID (plain ID)
+func parseFolderURL(input string) (string, error) {
+	input = strings.TrimSpace(input)
+
+	// If it doesn't look like a URL, treat as a raw folder ID.
+	if !strings.Contains(input, "/") {
+		return input, nil
+	}
+
+	u, err := url.Parse(input)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+	if id := u.Query().Get("id"); id != "" {
+		return id, nil
+	}
+
+	// Expected path: /drive/.../folders/FOLDER_ID
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i, part := range parts {
+		if part == "folders" && i+1 < len(parts) {
+			return parts[i+1], nil
+		}
+	}
+
+	return "", fmt.Errorf("could not extract folder ID from URL: %s", input)
+}
+
+// ExportFolder exports every Google Doc in a Drive folder and its
+// subfolders, mirroring the folder structure under outputDir.
+func ExportFolder(ctx context.Context, client *http.Client, folderID, outputDir string, opts ExportOptions) error {
+	x, err := newExporter(ctx, client, opts.Concurrency)
+	if err != nil {
+		return err
+	}
+	return x.exportFolder(ctx, folderID, outputDir, opts)
+}
+
+// exportFolder is ExportFolder using x's client and image download pool.
+func (x *exporter) exportFolder(ctx context.Context, folderID, outputDir string, opts ExportOptions) error {
+	logf("Listing folder %s...\n", folderID)
+	targets, err := listFolderDocs(ctx, x.drive, folderID, opts.Filenames)
+	if err != nil {
+		return driveScopeHint(err)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no Google Docs found in folder %s", folderID)
+	}
+	logf("Found %d document(s)\n", len(targets))
+	logEvent("folder_listed", "folder_id", folderID, "documents", len(targets))
+
+	return x.exportMany(ctx, targets, outputDir, opts)
+}
+
+// listFolderDocs walks a folder tree depth-first and returns a target for
+// every Google Doc in it. Each target's dir is the path of its folder
+// relative to the root, with folder names made safe by namer. Shortcuts to
+// documents and folders are followed; a folder reachable twice is listed once.
+func listFolderDocs(ctx context.Context, srv *drive.Service, rootID string, namer filenamer) ([]docTarget, error) {
+	var targets []docTarget
+	visited := make(map[string]bool)
+
+	var walk func(folderID, dir string) error
+	walk = func(folderID, dir string) error {
+		if visited[folderID] {
+			return nil
+		}
+		visited[folderID] = true
+
+		var files []*drive.File
+		q := fmt.Sprintf("'%s' in parents and trashed = false and (mimeType = '%s' or mimeType = '%s' or mimeType = '%s')",
+			folderID, mimeDocument, mimeFolder, mimeShortcut)
+		err := srv.Files.List().
+			Q(q).
+			Fields("nextPageToken, files(id, name, mimeType, shortcutDetails)").
+			OrderBy("folder,name").
+			SupportsAllDrives(true).
+			IncludeItemsFromAllDrives(true).
+			Pages(ctx, func(page *drive.FileList) error {
+				files = append(files, page.Files...)
+				return nil
+			})
+		if err != nil {
+			return fmt.Errorf("failed to list folder %s: %w", folderID, err)
+		}
+
+		// Subfolders sharing a name are disambiguated like tab files.
+		used := make(pathSet)
+		for _, f := range files {
+			id, mimeType := f.Id, f.MimeType
+			if mimeType == mimeShortcut && f.ShortcutDetails != nil {
+				id, mimeType = f.ShortcutDetails.TargetId, f.ShortcutDetails.TargetMimeType
+			}
+			switch mimeType {
+			case mimeDocument:
+				targets = append(targets, docTarget{
+					input: "https://docs.google.com/document/d/" + id,
+					docID: id,
+					title: f.Name,
+					dir:   dir,
+				})
+			case mimeFolder:
+				base := namer.name(nameData{Title: f.Name, ID: id})
+				name := base
+				if !used.claim(name) {
+					name = namer.suffix(base, id)
+					for n := 2; !used.claim(name); n++ {
+						name = namer.suffix(base, fmt.Sprint(n))
+					}
+				}
+				if err := walk(id, path.Join(dir, name)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := walk(rootID, ""); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// driveScopeHint explains a permission error caused by a token saved
+// before gdoc2md asked for Drive access.
+func driveScopeHint(err error) error {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusForbidden &&
+		strings.Contains(strings.ToLower(gerr.Message), "insufficient") {
+		return fmt.Errorf("%w\nThe saved authorization does not include Google Drive access. Delete ~/.gdoc2md/token.json and run again to re-authorize.", err)
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// commitExport commits what an export wrote to outputDir, if anything
+// changed, to the git repository containing it. Only the export's own
+// files, those it removed and its manifest are committed; anything else in
+// outputDir is left alone. The message lists the changed tabs, the
+// document revision and who last modified the document.
+func (x *exporter) commitExport(ctx context.Context, outputDir string, report *ExportReport) error {
+	paths := []string{manifestFile}
+	for _, f := range report.Files {
+		if f.URL == "" {
+			paths = append(paths, f.Path)
+		}
+	}
+	if len(report.Removed) > 0 {
+		// A removed file only needs committing if git tracked it.
+		tracked, err := runGit(ctx, outputDir, "", append([]string{"ls-files", "-z", "--"}, literalPaths(report.Removed)...)...)
+		if err != nil {
+			return fmt.Errorf("failed to list tracked files: %w", err)
+		}
+		for _, p := range strings.Split(tracked, "\x00") {
+			if p != "" {
+				paths = append(paths, p)
+			}
+		}
+	}
+	_, err := gitCommit(ctx, outputDir, paths, func() string {
+		return x.commitMessage(ctx, report)
+	})
+	return err
+}
+
+func (x *exporter) commitMessage(ctx context.Context, report *ExportReport) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Update %s from Google Docs\n\n", report.Title)
+	if len(report.Changed) > 0 {
+		sb.WriteString("Changed tabs:\n")
+		for _, title := range report.Changed {
+			fmt.Fprintf(&sb, "- %s\n", title)
+		}
+		sb.WriteString("\n")
+	}
+	fmt.Fprintf(&sb, "Document: https://docs.google.com/document/d/%s\n", report.DocID)
+	if report.RevisionID != "" {
+		fmt.Fprintf(&sb, "Revision: %s\n", report.RevisionID)
+	}
+
+	// The Docs API does not say who edited a document; Drive does.
+	f, err := x.drive.Files.Get(report.DocID).
+		Fields("lastModifyingUser(displayName, emailAddress)").
+		SupportsAllDrives(true).
+		Context(ctx).
+		Do()
+	switch {
+	case err != nil:
+		warnf("could not look up who last modified the document: %v\n", driveScopeHint(err))
+	case f.LastModifyingUser != nil && f.LastModifyingUser.EmailAddress != "":
+		fmt.Fprintf(&sb, "Last modified by: %s <%s>\n", f.LastModifyingUser.DisplayName, f.LastModifyingUser.EmailAddress)
+	case f.LastModifyingUser != nil:
+		fmt.Fprintf(&sb, "Last modified by: %s\n", f.LastModifyingUser.DisplayName)
+	}
+	return sb.String()
+}
+
+// gitCommit stages paths, relative to dir, in the git repository
+// containing dir and commits them with the message returned by message,
+// which is only called if there is something to commit. Each path must
+// exist or be tracked by git. Nothing else staged in the repository is
+// included, and nothing is pushed. It reports whether a commit was made.
+func gitCommit(ctx context.Context, dir string, paths []string, message func() string) (bool, error) {
+	pathspec := literalPaths(paths)
+	// Once started, let git finish even if the export is interrupted, so
+	// the repository is not left with a stale index.lock.
+	ctx = context.WithoutCancel(ctx)
+
+	if _, err := runGit(ctx, dir, "", "rev-parse", "--show-toplevel"); err != nil {
+		return false, fmt.Errorf("cannot commit: %s is not inside a git repository: %w", dir, err)
+	}
+	if _, err := runGit(ctx, dir, "", append([]string{"add", "--all", "--"}, pathspec...)...); err != nil {
+		return false, fmt.Errorf("failed to stage %s: %w", dir, err)
+	}
+
+	_, err := runGit(ctx, dir, "", append([]string{"diff", "--cached", "--quiet", "--"}, pathspec...)...)
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		logf("Nothing to commit.\n")
+		return false, nil
+	case !errors.As(err, &exitErr) || exitErr.ExitCode() != 1:
+		return false, fmt.Errorf("failed to check for staged changes: %w", err)
+	}
+
+	if _, err := runGit(ctx, dir, message(), append([]string{"commit", "--quiet", "--file=-", "--"}, pathspec...)...); err != nil {
+		return false, fmt.Errorf("failed to commit: %w", err)
+	}
+	head, err := runGit(ctx, dir, "", "rev-parse", "--short", "HEAD")
+	if err != nil {
+		return true, nil
+	}
+	logf("Committed %s\n", head)
+	logEvent("git_commit", "dir", dir, "commit", head)
+	return true, nil
+}
+
+// literalPaths turns paths into pathspecs matching exactly those paths, so
+// that file names with glob characters are not expanded.
+func literalPaths(paths []string) []string {
+	specs := make([]string, len(paths))
+	for i, p := range paths {
+		specs[i] = ":(literal)" + p
+	}
+	return specs
+}
+
+// runGit runs git in dir with the given standard input and returns its
+// trimmed standard output. A failure includes what git printed to stderr.
+func runGit(ctx context.Context, dir, stdin string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
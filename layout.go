@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// reservedPaths are output paths gdoc2md writes itself, so no tab may claim
+// them. The image directory is reserved too, see assignTabPaths.
+var reservedPaths = []string{"tabs.md"}
+
+// assignTabPaths decides where each tab is written, relative to the output
+// directory. By default every tab is a file in the output directory; in
+// nested mode a tab with children becomes a directory holding its own
+// content as opts.NestedIndex (index.md by default) next to its children.
+//
+// Paths are unique across all tabs, compared case-insensitively so that the
+// output is safe on macOS and Windows checkouts. When two tabs would map to
+// the same path, the first one in tree order keeps it and later ones are
+// disambiguated deterministically (see pathCandidates).
+func assignTabPaths(results []tabResult, opts ExportOptions) {
+	hasChildren := make(map[string]bool)
+	names := make(map[string]string)
+	for i, r := range results {
+		names[r.id] = opts.Filenames.name(nameData{
+			Title: r.title,
+			ID:    r.id,
+			Index: i,
+			Depth: r.depth,
+		})
+		if r.parentID != "" {
+			hasChildren[r.parentID] = true
+		}
+	}
+
+	used := make(pathSet)
+	for _, p := range reservedPaths {
+		used.claim(p)
+	}
+	used.claim(opts.imageDir() + "/")
+
+	// dirs maps a tab ID to the directory its children are written into.
+	dirs := make(map[string]string)
+	for i := range results {
+		r := &results[i]
+		parentDir := ""
+		if opts.Nested {
+			parentDir = dirs[r.parentID]
+		}
+		isDir := opts.Nested && hasChildren[r.id]
+
+		claim := func(name string) bool {
+			key := path.Join(parentDir, name)
+			if isDir {
+				key += "/"
+			} else {
+				key += ".md"
+			}
+			return used.claim(key)
+		}
+		var name string
+		for _, candidate := range pathCandidates(opts.Filenames, r, names, opts.Nested) {
+			if claim(candidate) {
+				name = candidate
+				break
+			}
+		}
+		for n := 2; name == ""; n++ {
+			if candidate := opts.Filenames.suffix(names[r.id], fmt.Sprint(n)); claim(candidate) {
+				name = candidate
+			}
+		}
+
+		if isDir {
+			dir := path.Join(parentDir, name)
+			dirs[r.id] = dir
+			r.path = path.Join(dir, opts.nestedIndex())
+			used.claim(r.path)
+		} else {
+			r.path = path.Join(parentDir, name+".md")
+		}
+	}
+}
+
+// pathCandidates lists the names to try for a tab, in order of preference:
+// its own name, then prefixed with its parent's name (unless the parent is
+// already a directory), then suffixed with its tab ID. If all are taken the
+// caller falls back to numbered names.
+func pathCandidates(f filenamer, r *tabResult, names map[string]string, nested bool) []string {
+	name := names[r.id]
+	candidates := []string{name}
+	if parent, ok := names[r.parentID]; ok && r.parentID != "" && !nested {
+		candidates = append(candidates, f.join(parent, name))
+	}
+	if r.id != "" {
+		candidates = append(candidates, f.suffix(name, r.id))
+	}
+	return candidates
+}
+
+// pathSet tracks claimed output paths case-insensitively.
+type pathSet map[string]bool
+
+// claim marks p as used, reporting false if it was already taken.
+func (s pathSet) claim(p string) bool {
+	key := strings.ToLower(p)
+	if s[key] {
+		return false
+	}
+	s[key] = true
+	return true
+}
+
+// relativePrefix returns the "../" sequence leading from the directory of
+// the slash-separated relative path p back to the output directory.
+func relativePrefix(p string) string {
+	dir := path.Dir(p)
+	if dir == "." {
+		return ""
+	}
+	return strings.Repeat("../", strings.Count(dir, "/")+1)
+}
+
+// nestedIndex returns the filename of a parent tab's own content in nested
+// mode.
+func (o ExportOptions) nestedIndex() string {
+	if o.NestedIndex == "" {
+		return "index.md"
+	}
+	return o.NestedIndex
+}
+
+// imageDir returns the directory images are written to, relative to the
+// output directory.
+func (o ExportOptions) imageDir() string {
+	if o.ImageDir == "" {
+		return "images"
+	}
+	return o.ImageDir
+}
+
+// tabImageDir returns the directory the images of the tab written to
+// tabPath go into: the image directory, or with ImagesPerTab a subfolder
+// of it named after the tab's file ("images/Guides/Setup" for
+// Guides/Setup.md, "images/Guides" for the nested index Guides/index.md).
+func (o ExportOptions) tabImageDir(tabPath string) string {
+	if !o.ImagesPerTab {
+		return o.imageDir()
+	}
+	if o.Nested && path.Dir(tabPath) != "." && path.Base(tabPath) == o.nestedIndex() {
+		return o.imageDir() + "/" + path.Dir(tabPath)
+	}
+	return o.imageDir() + "/" + strings.TrimSuffix(tabPath, path.Ext(tabPath))
+}
+
+// imageLinkPrefix returns what image filenames are prefixed with in links
+// written to the Markdown file at mdPath, for the images of the tab
+// written to tabPath and stored in assets. Both paths are relative to the
+// output directory.
+func (o ExportOptions) imageLinkPrefix(assets assetSink, mdPath, tabPath string) string {
+	dir := o.tabImageDir(tabPath)
+	if u := assets.URL(dir + "/"); u != "" {
+		return u
+	}
+	if o.ImageURL == "" {
+		return linkTarget(relativePrefix(mdPath)+dir) + "/"
+	}
+	sub := strings.TrimPrefix(strings.TrimPrefix(dir, o.imageDir()), "/")
+	prefix := strings.TrimSuffix(o.ImageURL, "/") + "/"
+	if sub != "" {
+		prefix += linkTarget(sub) + "/"
+	}
+	return prefix
+}
+
+// cleanImageDir validates an -image-dir argument: a relative path that
+// stays inside the output directory. It returns the path slash-separated
+// and cleaned.
+func cleanImageDir(dir string) (string, error) {
+	p := path.Clean(filepath.ToSlash(dir))
+	if filepath.IsAbs(dir) || path.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("image directory %q must be a path inside the output directory", dir)
+	}
+	return p, nil
+}
+
+// cleanNestedIndex validates a nested index filename given by the user. It
+// must be a plain Markdown filename, so that a parent tab's content stays
+// inside the parent's directory; "" means index.md.
+func cleanNestedIndex(name string) (string, error) {
+	if name == "" {
+		return "index.md", nil
+	}
+	if strings.ContainsAny(name, `/\`) || safeFilename(name) != name ||
+		!strings.EqualFold(path.Ext(name), ".md") || name == path.Ext(name) {
+		return "", fmt.Errorf("nested index %q must be a Markdown filename such as index.md or README.md", name)
+	}
+	return name, nil
+}
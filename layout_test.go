@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAssignTabPathsLongTitles(t *testing.T) {
+	title := strings.Repeat("Quarterly planning notes ", 6)[:130]
+	for _, strategy := range []string{"title", "slug"} {
+		namer, err := newFilenamer(strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The last two tabs have no ID, so they need numbered names.
+		results := []tabResult{
+			{id: "t.a", title: title},
+			{id: "t.b", title: title},
+			{title: title},
+			{title: title},
+		}
+		assignTabPaths(results, ExportOptions{Filenames: namer})
+
+		seen := make(map[string]bool)
+		for _, r := range results {
+			name := strings.TrimSuffix(r.path, ".md")
+			if len(name) > maxNameBytes {
+				t.Errorf("%s: %q is longer than %d bytes", strategy, name, maxNameBytes)
+			}
+			if seen[r.path] {
+				t.Errorf("%s: %q assigned twice", strategy, r.path)
+			}
+			seen[r.path] = true
+		}
+	}
+}
+
+func TestCleanNestedIndex(t *testing.T) {
+	for name, want := range map[string]string{
+		"":          "index.md",
+		"index.md":  "index.md",
+		"README.md": "README.md",
+		"Notes.MD":  "Notes.MD",
+	} {
+		if got, err := cleanNestedIndex(name); err != nil || got != want {
+			t.Errorf("cleanNestedIndex(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	for _, name := range []string{"../../evil.md", "sub/index.md", `sub\index.md`, "..", ".md", "index.txt", "index", " index.md", "con.md"} {
+		if got, err := cleanNestedIndex(name); err == nil {
+			t.Errorf("cleanNestedIndex(%q) = %q, want an error", name, got)
+		}
+	}
+}
+
+func TestAssignTabPathsNestedIndexDefault(t *testing.T) {
+	namer, _ := newFilenamer("title")
+	results := []tabResult{
+		{id: "t.a", title: "Parent"},
+		{id: "t.b", title: "Child", parentID: "t.a", depth: 1},
+	}
+	assignTabPaths(results, ExportOptions{Filenames: namer, Nested: true})
+	if results[0].path != "Parent/index.md" || results[1].path != "Parent/Child.md" {
+		t.Errorf("paths = %q, %q", results[0].path, results[1].path)
+	}
+}
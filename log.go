@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Progress is reported in one of two ways. By default, logf prints
+// human-readable lines to stdout and warnf prints warnings to stderr. With
+// -log-format json, those lines are dropped and logEvent writes structured
+// events to stderr instead, one JSON object per line, with the event name
+// as "msg". -quiet keeps only warnings in either mode.
+var (
+	jsonLog *slog.Logger // set for -log-format json
+	quiet   bool
+)
+
+// setupLogging applies the -log-format and -quiet flags.
+func setupLogging(format string, beQuiet bool) error {
+	quiet = beQuiet
+	switch format {
+	case "text":
+	case "json":
+		level := slog.LevelInfo
+		if beQuiet {
+			level = slog.LevelWarn
+		}
+		jsonLog = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	default:
+		return fmt.Errorf("unknown log format %q (want text or json)", format)
+	}
+	return nil
+}
+
+// logf prints a line of progress in text mode.
+func logf(format string, args ...any) {
+	if quiet || jsonLog != nil {
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// warnf reports a problem that does not stop the export.
+func warnf(format string, args ...any) {
+	if jsonLog != nil {
+		jsonLog.Warn("warning", "message", strings.TrimSpace(fmt.Sprintf(format, args...)))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Warning: "+format, args...)
+}
+
+// logEvent emits a structured event in JSON mode. attrs alternate keys and
+// values, as for slog.
+func logEvent(event string, attrs ...any) {
+	if jsonLog != nil {
+		jsonLog.Info(event, attrs...)
+	}
+}
+
+// logWarnEvent emits a structured warning event in JSON mode.
+func logWarnEvent(event string, attrs ...any) {
+	if jsonLog != nil {
+		jsonLog.Warn(event, attrs...)
+	}
+}
+
+// ms converts a duration to fractional milliseconds for events.
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// errorf reports an error that stops the run or one of its documents.
+func errorf(format string, args ...any) {
+	if jsonLog != nil {
+		jsonLog.Error("error", "message", strings.TrimSpace(fmt.Sprintf(format, args...)))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Error: "+format, args...)
+}
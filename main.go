@@ -4,22 +4,68 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/oauth2"
 )
 
 var version = "dev"
 
 func main() {
-	outputDir := flag.String("o", ".", "output directory")
+	outputDir := flag.String("o", ".", "output directory, archive (.zip, .tar.gz) or '-' for stdout")
+	singleFile := flag.Bool("single-file", false, "combine all tabs into one markdown file")
+	nested := flag.Bool("nested", false, "write child tabs into subdirectories named after their parent tab")
+	nestedIndex := flag.String("nested-index", "index.md", "filename for a parent tab's content in nested mode (e.g. README.md)")
+	filenames := flag.String("filenames", "title", "filename strategy: title, slug, id, or a Go template such as '{{.Index}}-{{.Slug}}'")
+	var tabs, excludeTabs stringList
+	flag.Var(&tabs, "tab", "export only this tab (title, tab ID or glob over the tab path); repeatable")
+	flag.Var(&excludeTabs, "exclude-tab", "skip this tab (title, tab ID or glob over the tab path); repeatable")
+	force := flag.Bool("force", false, "rewrite all files and re-download all images, ignoring the previous export's manifest")
+	prune := flag.Bool("prune", false, "remove files written by the previous export that this export no longer produces")
+	imageDir := flag.String("image-dir", "images", "directory to write images to, relative to the output directory")
+	imageURL := flag.String("image-url", "", "prefix for image links in place of the image directory, e.g. /static/img/ (default: relative links)")
+	imageStore := flag.String("image-store", "", "upload images to this S3-compatible bucket (s3://bucket/prefix) and link them by URL")
+	s3Endpoint := flag.String("s3-endpoint", "", "endpoint of the -image-store, e.g. http://localhost:9000 for MinIO (default: AWS S3)")
+	imagesPerTab := flag.Bool("images-per-tab", false, "put each tab's images into its own subfolder of the image directory")
+	noCache := flag.Bool("no-cache", false, "download every image instead of reusing copies from the image cache")
+	cacheSize := flag.Int64("cache-size", 500, "size limit of the image cache, in MB (0 for no limit)")
+	strict := flag.Bool("strict", false, "fail if any image cannot be downloaded instead of writing a placeholder")
+	maxImageSize := flag.Int64("max-image-size", 50, "largest image to download, in MB (0 for no limit); larger images count as failed")
+	reportPath := flag.String("report", "", "write a JSON report of image download failures to this file")
+	gitCommit := flag.Bool("git-commit", false, "after exporting, commit the output directory to the git repository it is in")
+	fromFile := flag.String("from-file", "", "read document URLs or IDs from this file, one per line ('-' for stdin)")
+	interval := flag.Duration("interval", 30*time.Second, "how often watch checks the document for changes")
+	dryRun := flag.Bool("dry-run", false, "list the stale files --prune would remove without removing them")
+	var concurrency int
+	flag.IntVar(&concurrency, "j", defaultConcurrency, "download this many images at once")
+	flag.IntVar(&concurrency, "concurrency", defaultConcurrency, "same as -j")
+	rate := flag.Float64("rate", defaultRate, "send at most this many HTTP requests per second, image downloads included (0 for no limit)")
+	docsRate := flag.Float64("docs-rate", defaultDocsRate, "send at most this many Docs API requests per second (0 for no limit)")
+	retries := flag.Int("retries", 4, "retry each request this many times on rate limiting, server errors or network errors")
+	maxRequests := flag.Int("max-requests", 0, "give up after this many HTTP requests in total, retries included (0 for no limit)")
+	saveJSON := flag.String("save-json", "", "also write the document's raw Docs API response to this file, for gdoc2md convert")
+	stats := flag.Bool("stats", false, "also fetch each document without the field mask and report the payload and time it saves")
+	logFormat := flag.String("log-format", "text", "progress output format: text, or json for one event per line on stderr")
+	beQuiet := flag.Bool("quiet", false, "print only warnings and errors")
+	summaryPath := flag.String("summary", "", "write a JSON summary of every export (files, sizes, hashes, timings) to this file")
 	showVersion := flag.Bool("version", false, "print version and exit")
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: gdoc2md [flags] <command|url>\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: gdoc2md [flags] <command|url...>\n\n")
 		fmt.Fprintf(os.Stderr, "Commands:\n")
-		fmt.Fprintf(os.Stderr, "  configure    Set up Google OAuth2 credentials\n\n")
+		fmt.Fprintf(os.Stderr, "  configure    Set up Google OAuth2 credentials\n")
+		fmt.Fprintf(os.Stderr, "  folder       Export every Google Doc in a Drive folder, recursively\n")
+		fmt.Fprintf(os.Stderr, "  watch        Re-export a document whenever it changes, until interrupted\n")
+		fmt.Fprintf(os.Stderr, "  sync         Export the documents listed in gdoc2md.yaml (or the given project file)\n")
+		fmt.Fprintf(os.Stderr, "  convert      Convert a document saved with --save-json, offline\n")
+		fmt.Fprintf(os.Stderr, "  cache clear  Remove all images from the image cache\n\n")
 		fmt.Fprintf(os.Stderr, "Arguments:\n")
-		fmt.Fprintf(os.Stderr, "  url          Google Docs URL to export\n\n")
+		fmt.Fprintf(os.Stderr, "  url          Google Docs URL or document ID to export; several may be given\n\n")
 		fmt.Fprintf(os.Stderr, "Flags:\n")
 		flag.PrintDefaults()
 	}
@@ -31,37 +77,276 @@ func main() {
 	}
 
 	args := flag.Args()
-	if len(args) == 0 {
+	if len(args) == 0 && *fromFile == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	ctx := context.Background()
+	command := ""
+	if len(args) > 0 && commands[args[0]] {
+		command = args[0]
+		// Flags may also follow the command name: "gdoc2md folder -o out URL".
+		_ = flag.CommandLine.Parse(args[1:])
+		args = flag.Args()
+	}
 
-	switch args[0] {
-	case "configure":
-		if err := runConfigure(); err != nil {
+	if *outputDir == "-" {
+		// stdout carries the Markdown (see streamOut); progress goes to stderr.
+		os.Stdout = os.Stderr
+	}
+	if !isDirOutput(*outputDir) {
+		switch {
+		case command == "folder" || command == "watch":
+			fmt.Fprintf(os.Stderr, "Error: %s needs an output directory\n", command)
+			os.Exit(1)
+		case *gitCommit:
+			fmt.Fprintf(os.Stderr, "Error: --git-commit needs an output directory\n")
+			os.Exit(1)
+		}
+	}
+	switch {
+	case *saveJSON != "" && (command == "folder" || command == "sync" || command == "convert"):
+		fmt.Fprintf(os.Stderr, "Error: --save-json cannot be used with %s\n", command)
+		os.Exit(1)
+	case command == "convert" && *gitCommit:
+		// The commit author is looked up in Drive.
+		fmt.Fprintf(os.Stderr, "Error: --git-commit cannot be used with convert\n")
+		os.Exit(1)
+	}
+
+	if err := setupLogging(*logFormat, *beQuiet); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *retries < 0 || *maxRequests < 0 || *maxImageSize < 0 || *cacheSize < 0 || *rate < 0 || *docsRate < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -retries, -max-requests, -max-image-size, -cache-size, -rate and -docs-rate cannot be negative\n")
+		os.Exit(1)
+	}
+	if concurrency < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -j must be at least 1\n")
+		os.Exit(1)
+	}
+
+	// Every client in the run, including token refreshes, sends its
+	// requests through one retrying transport that also enforces the
+	// request budget, on top of one rate limiter.
+	baseClient := &http.Client{
+		Transport: newRetryTransport(newRateLimitTransport(http.DefaultTransport, *rate, *docsRate), *retries, *maxRequests),
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, baseClient)
+
+	// Ctrl-C cancels the run: work in progress is discarded, what already
+	// finished is kept. A second Ctrl-C exits immediately.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		if jsonLog != nil {
+			logWarnEvent("interrupted")
+			return
+		}
+		fmt.Fprintln(os.Stderr, "\nInterrupted, cleaning up (press Ctrl-C again to quit immediately)...")
+	}()
+
+	if command == "cache" {
+		if err := runCache(args); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-	default:
-		docID, err := extractDocID(args[0])
-		if err != nil {
+		return
+	}
+
+	if command == "configure" {
+		if err := runConfigure(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
+		return
+	}
 
-		client, err := GetAuthenticatedClient(ctx)
+	namer, err := newFilenamer(*filenames)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	imageDirPath, err := cleanImageDir(*imageDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	nestedIndexName, err := cleanNestedIndex(*nestedIndex)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	opts := ExportOptions{
+		SingleFile:   *singleFile,
+		Nested:       *nested,
+		NestedIndex:  nestedIndexName,
+		Filenames:    namer,
+		Tabs:         tabs,
+		ExcludeTabs:  excludeTabs,
+		Force:        *force,
+		Prune:        *prune,
+		DryRun:       *dryRun,
+		ImageDir:     imageDirPath,
+		ImagesPerTab: *imagesPerTab,
+		ImageURL:     *imageURL,
+		Strict:       *strict,
+		MaxImageSize: *maxImageSize << 20,
+		GitCommit:    *gitCommit,
+		Concurrency:  concurrency,
+		SaveJSON:     *saveJSON,
+		Stats:        *stats,
+	}
+	if *imageStore != "" {
+		// With a store, -image-url stands in for the bucket's URL.
+		opts.ImageURL = ""
+		opts.ImageStore, err = newBucketStore(*imageStore, *s3Endpoint, *imageURL, baseClient)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
+	}
+	if !*noCache {
+		// The cache only saves work; run without it if it cannot be used.
+		if opts.Cache, err = newImageCache(*cacheSize << 20); err != nil {
+			warnf("%v\n", err)
+		}
+	}
+	if *reportPath != "" {
+		opts.Failures = &FailureReport{}
+	}
+	if *summaryPath != "" {
+		opts.Summary = &RunSummary{}
+	}
 
-		if err := ExportDoc(ctx, client, docID, *outputDir); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	switch command {
+	case "folder":
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: gdoc2md [flags] folder <folder-url>\n")
+			os.Exit(1)
+		}
+		err = runFolder(ctx, args[0], *outputDir, opts)
+	case "watch":
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: gdoc2md [flags] watch <url>\n")
 			os.Exit(1)
 		}
+		err = runWatch(ctx, args[0], *outputDir, opts, *interval)
+	case "sync":
+		if len(args) > 1 {
+			fmt.Fprintf(os.Stderr, "Usage: gdoc2md [flags] sync [project-file]\n")
+			os.Exit(1)
+		}
+		configPath := ""
+		if len(args) == 1 {
+			configPath = args[0]
+		}
+		err = runSync(ctx, configPath, opts)
+	case "convert":
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: gdoc2md [flags] convert <file.json>\n")
+			os.Exit(1)
+		}
+		err = runConvert(ctx, args[0], *outputDir, opts)
+	default:
+		inputs := args
+		if *fromFile != "" {
+			listed, err := readDocList(*fromFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			inputs = append(inputs, listed...)
+		}
+		err = runExport(ctx, inputs, *outputDir, opts, *fromFile != "")
+	}
+	if opts.Failures != nil {
+		if saveErr := opts.Failures.save(*reportPath); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	if opts.Summary != nil {
+		if saveErr := opts.Summary.save(*summaryPath); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			if jsonLog != nil {
+				jsonLog.Error("interrupted", "error", err.Error())
+			} else {
+				fmt.Fprintf(os.Stderr, "Interrupted: %v\n", err)
+			}
+			os.Exit(130)
+		}
+		errorf("%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// commands are the subcommand names recognized as the first argument.
+var commands = map[string]bool{
+	"cache":     true,
+	"configure": true,
+	"convert":   true,
+	"folder":    true,
+	"sync":      true,
+	"watch":     true,
+}
+
+// runExport exports the given documents. A single document given on the
+// command line is written straight into outputDir; several documents, or
+// any read from a list, each get their own subdirectory.
+func runExport(ctx context.Context, inputs []string, outputDir string, opts ExportOptions, fromList bool) error {
+	targets, err := parseDocTargets(inputs)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no documents to export")
+	}
+
+	client, err := GetAuthenticatedClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(targets) > 1 || fromList {
+		if !isDirOutput(outputDir) {
+			return fmt.Errorf("exporting several documents needs an output directory")
+		}
+		if opts.SaveJSON != "" {
+			return fmt.Errorf("--save-json saves a single document")
+		}
+		x, err := newExporter(ctx, client, opts.Concurrency)
+		if err != nil {
+			return err
+		}
+		return x.exportMany(ctx, targets, outputDir, opts)
+	}
+
+	t := targets[0]
+	if t.tabID != "" {
+		opts.Tabs = append(opts.Tabs, t.tabID)
+	}
+	_, err = ExportDoc(ctx, client, t.docID, outputDir, opts)
+	return err
+}
+
+// runFolder exports every Google Doc in a Drive folder tree.
+func runFolder(ctx context.Context, input, outputDir string, opts ExportOptions) error {
+	folderID, err := parseFolderURL(input)
+	if err != nil {
+		return err
+	}
+	client, err := GetAuthenticatedClient(ctx)
+	if err != nil {
+		return err
 	}
+	return ExportFolder(ctx, client, folderID, outputDir, opts)
 }
 
 func runConfigure() error {
@@ -96,31 +381,43 @@ func runConfigure() error {
 	return nil
 }
 
-// extractDocID parses a Google Docs URL and returns the document ID.
+// parseDocURL parses a Google Docs URL and returns the document ID and,
+// if the URL links to a specific tab, the tab ID.
 // Supports formats:
 //   - https://docs.google.com/document/d/DOC_ID/edit
+//   - https://docs.google.com/document/d/DOC_ID/edit?tab=t.TAB_ID
 //   - https://docs.google.com/document/d/DOC_ID
 //   - DOC_ID (plain ID)
-func extractDocID(input string) (string, error) {
+func parseDocURL(input string) (docID, tabID string, err error) {
 	input = strings.TrimSpace(input)
 
 	// If it doesn't look like a URL, treat as a raw document ID.
 	if !strings.Contains(input, "/") {
-		return input, nil
+		return input, "", nil
 	}
 
 	u, err := url.Parse(input)
 	if err != nil {
-		return "", fmt.Errorf("invalid URL: %w", err)
+		return "", "", fmt.Errorf("invalid URL: %w", err)
 	}
 
 	// Expected path: /document/d/DOC_ID/...
 	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
 	for i, part := range parts {
 		if part == "d" && i+1 < len(parts) {
-			return parts[i+1], nil
+			return parts[i+1], u.Query().Get("tab"), nil
 		}
 	}
 
-	return "", fmt.Errorf("could not extract document ID from URL: %s", input)
+	return "", "", fmt.Errorf("could not extract document ID from URL: %s", input)
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ", ") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// manifestFile is written into the output directory after every export.
+const manifestFile = ".gdoc2md.json"
+
+// Manifest records what an export produced, so that later runs can skip
+// work that has not changed.
+type Manifest struct {
+	DocID      string `json:"doc_id"`
+	Title      string `json:"title,omitempty"`
+	RevisionID string `json:"revision_id,omitempty"`
+	// Version and Options identify how the output was produced; a change
+	// in either means the output may differ even for the same revision.
+	Version string `json:"version"`
+	Options string `json:"options"`
+	// Incomplete is set when some images could not be downloaded, so the
+	// next run retries them even if the document is unchanged.
+	Incomplete bool `json:"incomplete,omitempty"`
+
+	Tabs   []ManifestEntry `json:"tabs,omitempty"`
+	Images []ManifestEntry `json:"images,omitempty"`
+	// Files lists other generated files: tabs.md or the single-file export.
+	Files []ManifestEntry `json:"files,omitempty"`
+	// Stale lists files an earlier export wrote that are no longer
+	// produced but have not been pruned yet.
+	Stale []ManifestEntry `json:"stale,omitempty"`
+}
+
+// ManifestEntry is one file written by an export. ID is the tab ID for
+// tabs and the inline object ID for images. URL is set for images
+// uploaded to an object store instead of written to the output directory.
+type ManifestEntry struct {
+	ID     string `json:"id,omitempty"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size,omitempty"`
+	URL    string `json:"url,omitempty"`
+}
+
+// entries returns every file the manifest records.
+func (m *Manifest) entries() []ManifestEntry {
+	var all []ManifestEntry
+	all = append(all, m.Tabs...)
+	all = append(all, m.Images...)
+	all = append(all, m.Files...)
+	return all
+}
+
+// report describes the export the manifest records, for a run that found
+// nothing to do.
+func (m *Manifest) report(outputDir string) *ExportReport {
+	r := &ExportReport{
+		DocID:      m.DocID,
+		Title:      m.Title,
+		RevisionID: m.RevisionID,
+		Unchanged:  true,
+		Files:      m.artifacts(outputDir, nil),
+	}
+	if len(m.Files) > 0 {
+		r.Entry = m.Files[0].Path
+	}
+	return r
+}
+
+// artifacts describes the files the manifest records; wrote says which of
+// them the current export wrote.
+func (m *Manifest) artifacts(outputDir string, wrote map[string]bool) []Artifact {
+	var all []Artifact
+	add := func(kind string, entries []ManifestEntry) {
+		for _, e := range entries {
+			if e.Size == 0 {
+				// Manifests from older versions do not record sizes.
+				if info, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(e.Path))); err == nil {
+					e.Size = info.Size()
+				}
+			}
+			all = append(all, Artifact{Path: e.Path, Kind: kind, Bytes: e.Size, SHA256: e.SHA256, URL: e.URL, Written: wrote[e.Path]})
+		}
+	}
+	add("tab", m.Tabs)
+	add("image", m.Images)
+	for _, e := range m.Files {
+		kind := "document"
+		if e.Path == "tabs.md" {
+			kind = "index"
+		}
+		add(kind, []ManifestEntry{e})
+	}
+	return all
+}
+
+// lookup returns the recorded entry for the given relative path.
+func (m *Manifest) lookup(path string) (ManifestEntry, bool) {
+	if m == nil {
+		return ManifestEntry{}, false
+	}
+	for _, e := range m.entries() {
+		if e.Path == path {
+			return e, true
+		}
+	}
+	return ManifestEntry{}, false
+}
+
+// upToDate reports whether the manifest describes an export of the given
+// revision with the same options, and every file it lists is still on disk
+// unmodified.
+func (m *Manifest) upToDate(outputDir, revisionID, options string) bool {
+	if m == nil || m.Incomplete || revisionID == "" || m.RevisionID != revisionID ||
+		m.Version != version || m.Options != options {
+		return false
+	}
+	for _, e := range m.entries() {
+		// Uploaded images are checked when the document changes, not on
+		// every run.
+		if e.URL == "" && !fileMatches(outputDir, e) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadManifest reads the manifest left by a previous export. It returns
+// nil if there is none or it cannot be parsed, which simply means nothing
+// can be skipped.
+func loadManifest(outputDir string) *Manifest {
+	data, err := os.ReadFile(filepath.Join(outputDir, manifestFile))
+	if err != nil {
+		return nil
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		warnf("ignoring unreadable %s: %v\n", manifestFile, err)
+		return nil
+	}
+	return &m
+}
+
+func saveManifest(stage outputSink, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := stage.WriteFile(manifestFile, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write %s: %w", manifestFile, err)
+	}
+	return nil
+}
+
+// fileMatches reports whether the file recorded by e exists in outputDir
+// with the recorded content.
+func fileMatches(outputDir string, e ManifestEntry) bool {
+	sum, err := hashFile(filepath.Join(outputDir, filepath.FromSlash(e.Path)))
+	return err == nil && sum == e.SHA256
+}
+
+// pruneStale finds files recorded in last that cur no longer produces and
+// returns those to remove when remove is set; with dryRun they are only
+// listed. Files that are kept stay tracked in cur.Stale so a later --prune
+// can still find them. Only files listed in the manifest are considered,
+// and a file modified since gdoc2md wrote it is left alone and no longer
+// tracked.
+func pruneStale(outputDir string, last, cur *Manifest, remove, dryRun bool) []string {
+	if last == nil {
+		return nil
+	}
+	// A path differing only in case is the same file on macOS and Windows,
+	// where a tab renamed from "Notes" to "notes" must not be removed, but
+	// not on Linux, where the old file would be left behind.
+	current := make(map[string]bool)
+	folded := make(map[string][]string)
+	for _, e := range cur.entries() {
+		current[e.Path] = true
+		key := strings.ToLower(e.Path)
+		folded[key] = append(folded[key], e.Path)
+	}
+	seen := make(map[string]bool)
+
+	var stale []string
+	for _, e := range append(last.entries(), last.Stale...) {
+		if current[e.Path] || seen[e.Path] {
+			continue
+		}
+		seen[e.Path] = true
+		if slices.ContainsFunc(folded[strings.ToLower(e.Path)], func(p string) bool {
+			return sameFile(outputDir, e.Path, p)
+		}) {
+			continue
+		}
+		path := filepath.Join(outputDir, filepath.FromSlash(e.Path))
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if !fileMatches(outputDir, e) {
+			if remove || dryRun {
+				logf("  Kept (modified since export): %s\n", path)
+				logEvent("prune_kept", "path", e.Path, "output", outputDir)
+			}
+			continue
+		}
+		if !remove || dryRun {
+			if dryRun {
+				logf("  Would remove: %s\n", path)
+				logEvent("prune_dry_run", "path", e.Path, "output", outputDir)
+			}
+			cur.Stale = append(cur.Stale, e)
+			continue
+		}
+		stale = append(stale, e.Path)
+	}
+	return stale
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sameFile reports whether the slash-separated paths a and b name the same
+// existing file in outputDir.
+func sameFile(outputDir, a, b string) bool {
+	fa, err := os.Lstat(filepath.Join(outputDir, filepath.FromSlash(a)))
+	if err != nil {
+		return false
+	}
+	fb, err := os.Lstat(filepath.Join(outputDir, filepath.FromSlash(b)))
+	return err == nil && os.SameFile(fa, fb)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPruneStaleCaseRename(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("# Notes\n")
+	if err := os.WriteFile(filepath.Join(dir, "Notes.md"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry := func(p string) ManifestEntry {
+		return ManifestEntry{Path: p, SHA256: hashBytes(data), Size: int64(len(data))}
+	}
+	last := &Manifest{Files: []ManifestEntry{entry("Notes.md")}}
+	cur := &Manifest{Files: []ManifestEntry{entry("notes.md")}}
+
+	// notes.md is only staged so far. On a case-insensitive filesystem it
+	// would be Notes.md, which must then be kept.
+	_, err := os.Lstat(filepath.Join(dir, "notes.md"))
+	caseInsensitive := err == nil
+
+	stale := pruneStale(dir, last, cur, true, false)
+	if caseInsensitive {
+		if len(stale) != 0 {
+			t.Errorf("stale = %q, want nothing on a case-insensitive filesystem", stale)
+		}
+	} else if !slices.Equal(stale, []string{"Notes.md"}) {
+		t.Errorf("stale = %q, want [Notes.md]", stale)
+	}
+
+	if stale := pruneStale(dir, last, last, true, false); len(stale) != 0 {
+		t.Errorf("stale = %q for an unchanged export, want nothing", stale)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// docIndexFile is the combined index written when exporting several documents.
+const docIndexFile = "index.md"
+
+// docTarget is one document requested for export.
+type docTarget struct {
+	input string // the URL or ID as given
+	docID string
+	tabID string // from a ?tab= URL parameter, if any
+	title string // if already known, e.g. from a folder listing
+	dir   string // parent directory within the output directory, slash-separated
+}
+
+func parseDocTargets(inputs []string) ([]docTarget, error) {
+	var targets []docTarget
+	for _, input := range inputs {
+		docID, tabID, err := parseDocURL(input)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, docTarget{input: input, docID: docID, tabID: tabID})
+	}
+	return targets, nil
+}
+
+// readDocList reads document URLs or IDs, one per line, from path, or from
+// stdin if path is "-". Blank lines and lines starting with # are ignored.
+func readDocList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var inputs []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		inputs = append(inputs, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return inputs, nil
+}
+
+// docOutcome records how the export of one document went.
+type docOutcome struct {
+	target docTarget
+	dir    string // subdirectory of the output directory, slash-separated
+	report *ExportReport
+	err    error
+}
+
+// exportMany exports each document into its own subdirectory of outputDir,
+// named after the document (following opts.Filenames), sharing x's client
+// and image download pool. It writes a combined index.md linking every
+// document exported and prints a per-document summary. A failed document
+// does not stop the others; an error is returned if any failed.
+func (x *exporter) exportMany(ctx context.Context, targets []docTarget, outputDir string, opts ExportOptions) error {
+	used := make(pathSet)
+	used.claim(docIndexFile)
+	// Folders from a folder listing hold other documents' directories, so
+	// no document directory may take their place.
+	for _, t := range targets {
+		for dir := t.dir; dir != "" && dir != "."; dir = path.Dir(dir) {
+			used.claim(dir + "/")
+		}
+	}
+	seen := make(map[string]bool)
+
+	var outcomes []docOutcome
+	for i, t := range targets {
+		if seen[t.docID+"\x00"+t.tabID] {
+			logf("Skipping duplicate %s\n", t.input)
+			continue
+		}
+		seen[t.docID+"\x00"+t.tabID] = true
+
+		o := docOutcome{target: t}
+		if err := ctx.Err(); err != nil {
+			o.err = err
+			outcomes = append(outcomes, o)
+			continue
+		}
+		title := t.title
+		if title == "" {
+			meta, err := x.srv.Documents.Get(t.docID).Fields("title").Context(ctx).Do()
+			if err != nil {
+				o.err = fmt.Errorf("failed to fetch document: %w", err)
+				outcomes = append(outcomes, o)
+				continue
+			}
+			title = meta.Title
+		}
+		claim := func(name string) bool { return used.claim(path.Join(t.dir, name) + "/") }
+		base := opts.Filenames.name(nameData{Title: title, ID: t.docID, Index: i})
+		name := base
+		if !claim(name) {
+			// The same document may be listed again for another tab.
+			name = opts.Filenames.suffix(base, t.docID)
+			for n := 2; !claim(name); n++ {
+				name = opts.Filenames.suffix(base, fmt.Sprint(n))
+			}
+		}
+		o.dir = path.Join(t.dir, name)
+
+		docOpts := opts
+		if t.tabID != "" {
+			docOpts.Tabs = append(slices.Clone(opts.Tabs), t.tabID)
+		}
+		logf("\n==> %s\n", path.Join(t.dir, title))
+		o.report, o.err = x.export(ctx, t.docID, filepath.Join(outputDir, filepath.FromSlash(o.dir)), docOpts)
+		outcomes = append(outcomes, o)
+	}
+
+	if err := writeDocIndex(outputDir, outcomes); err != nil {
+		return err
+	}
+	if opts.GitCommit {
+		if _, err := gitCommit(ctx, outputDir, []string{docIndexFile}, func() string {
+			return "Update document index from Google Docs\n"
+		}); err != nil {
+			return err
+		}
+	}
+	return summarize(outcomes)
+}
+
+// writeDocIndex writes index.md linking the entry file of every document
+// that was exported successfully. Documents from a folder tree are listed
+// under their folders.
+func writeDocIndex(outputDir string, outcomes []docOutcome) error {
+	var sb strings.Builder
+	sb.WriteString("# Documents\n\n")
+	var folders []string
+	for _, o := range outcomes {
+		if o.err != nil {
+			continue
+		}
+		var parts []string
+		if o.target.dir != "" {
+			parts = strings.Split(o.target.dir, "/")
+		}
+		// Open the folders not shared with the previous document.
+		common := 0
+		for common < len(parts) && common < len(folders) && parts[common] == folders[common] {
+			common++
+		}
+		for i := common; i < len(parts); i++ {
+			sb.WriteString(fmt.Sprintf("%s- %s/\n", strings.Repeat("  ", i), parts[i]))
+		}
+		folders = parts
+
+		indent := strings.Repeat("  ", len(parts))
+		sb.WriteString(fmt.Sprintf("%s- [%s](%s)\n", indent, o.report.Title, linkTarget(path.Join(o.dir, o.report.Entry))))
+	}
+	sb.WriteString("\n")
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+	indexPath := filepath.Join(outputDir, docIndexFile)
+	if err := writeFileAtomic(indexPath, []byte(sb.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", docIndexFile, err)
+	}
+	logf("\nWrote: %s\n", indexPath)
+	logEvent("file_written", "path", docIndexFile, "output", outputDir, "bytes", sb.Len())
+	return nil
+}
+
+// summarize prints one line per document and returns an error if any failed.
+func summarize(outcomes []docOutcome) error {
+	failed := 0
+	logf("\nSummary:\n")
+	for _, o := range outcomes {
+		switch {
+		case errors.Is(o.err, context.Canceled):
+			failed++
+			logf("  interrupted %s\n", o.target.input)
+		case o.err != nil:
+			failed++
+			logf("  FAILED     %s: %v\n", o.target.input, o.err)
+		case o.report.Unchanged:
+			logf("  unchanged  %s -> %s\n", o.report.Title, o.dir)
+		default:
+			logf("  ok         %s -> %s\n", o.report.Title, o.dir)
+		}
+	}
+	logf("%d succeeded, %d failed\n", len(outcomes)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d document(s) failed", failed, len(outcomes))
+	}
+	return nil
+}
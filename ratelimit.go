@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRate is the default limit on requests per second in a run,
+	// image downloads included.
+	defaultRate = 10
+	// defaultDocsRate keeps Docs API calls at 240 a minute, under the
+	// API's default quota of 300 read requests per minute per user.
+	defaultDocsRate = 4
+)
+
+// rateLimitTransport spaces out requests with token buckets: one shared by
+// every request of the run and one just for the Docs API, which has the
+// tightest quota. It sits below retryTransport, so retries wait their
+// turn too.
+type rateLimitTransport struct {
+	base http.RoundTripper
+	all  *tokenBucket
+	docs *tokenBucket
+}
+
+// newRateLimitTransport wraps base. A rate of 0 means no limit.
+func newRateLimitTransport(base http.RoundTripper, rate, docsRate float64) *rateLimitTransport {
+	return &rateLimitTransport{
+		base: base,
+		all:  newTokenBucket(rate),
+		docs: newTokenBucket(docsRate),
+	}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "docs.googleapis.com" {
+		if err := t.docs.wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.all.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// tokenBucket allows rate events per second on average, and bursts of up
+// to one second's worth after a quiet spell. A nil bucket allows anything.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := max(rate, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes a token, blocking until one is available or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	// Take the token now, even if it is not there yet, so that waiters
+	// are served in order.
+	b.tokens--
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ImageFailure describes an image that could not be downloaded.
+type ImageFailure struct {
+	DocID    string `json:"doc_id"`
+	Tab      string `json:"tab"`
+	TabID    string `json:"tab_id,omitempty"`
+	ObjectID string `json:"object_id"`
+	URI      string `json:"uri"`
+	// Path is where the image should have been written, relative to the
+	// document's output directory.
+	Path string `json:"path"`
+	// Status is the HTTP status of the failed response, or 0 if there was
+	// none, e.g. after a network error.
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error"`
+}
+
+// newImageFailure describes the failed download img of document docID.
+func newImageFailure(docID string, img imageDownload) ImageFailure {
+	f := ImageFailure{
+		DocID:    docID,
+		Tab:      img.tab,
+		TabID:    img.tabID,
+		ObjectID: img.ref.ObjectID,
+		URI:      img.ref.ContentURI,
+		Path:     img.path,
+		Error:    img.err.Error(),
+	}
+	var statusErr *httpStatusError
+	if errors.As(img.err, &statusErr) {
+		f.Status = statusErr.StatusCode
+	}
+	return f
+}
+
+// FailureReport collects the image download failures of every document
+// exported in a run, for -report. A nil report collects nothing.
+type FailureReport struct {
+	mu            sync.Mutex
+	ImageFailures []ImageFailure `json:"image_failures"`
+}
+
+func (r *FailureReport) add(failures ...ImageFailure) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ImageFailures = append(r.ImageFailures, failures...)
+}
+
+// save writes the report to path as JSON.
+func (r *FailureReport) save(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ImageFailures == nil {
+		r.ImageFailures = []ImageFailure{}
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+// Artifact is a file produced by an export, as listed by --summary.
+type Artifact struct {
+	// Path is relative to the output directory, slash-separated.
+	Path string `json:"path"`
+	// Kind is "tab", "image", "index" (tabs.md) or "document" (the
+	// --single-file output).
+	Kind   string `json:"kind"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+	// URL is set for images uploaded to an object store.
+	URL string `json:"url,omitempty"`
+	// Written is false for files left as the previous export wrote them.
+	Written bool `json:"written"`
+}
+
+// RunSummary collects the report of every document exported in a run,
+// for --summary. A nil summary collects nothing.
+type RunSummary struct {
+	mu        sync.Mutex
+	Version   string          `json:"version"`
+	Documents []*ExportReport `json:"documents"`
+}
+
+func (s *RunSummary) add(report *ExportReport) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Documents = append(s.Documents, report)
+}
+
+// save writes the summary to path as JSON.
+func (s *RunSummary) save(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Version = version
+	if s.Documents == nil {
+		s.Documents = []*ExportReport{}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write summary: %w", err)
+	}
+	return nil
+}
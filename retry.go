@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// retryBaseDelay is the backoff before the first retry; it doubles
+	// with every further attempt, up to retryMaxDelay.
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// errRequestBudget is returned once a run has made as many requests as
+// -max-requests allows.
+var errRequestBudget = errors.New("request budget exhausted (see -max-requests)")
+
+// retryTransport retries requests that fail with a network error or a
+// transient status (429, 5xx), waiting with exponential backoff and full
+// jitter between attempts, or as long as a Retry-After header asks. It is
+// the base transport of every client in a run, so Docs, Drive and image
+// requests alike are retried and counted against the request budget.
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	// remaining counts down the requests left in the run's budget; nil
+	// means unlimited.
+	remaining *atomic.Int64
+}
+
+// newRetryTransport wraps base. maxRequests of 0 allows any number of
+// requests.
+func newRetryTransport(base http.RoundTripper, maxRetries, maxRequests int) *retryTransport {
+	t := &retryTransport{base: base, maxRetries: maxRetries}
+	if maxRequests > 0 {
+		t.remaining = new(atomic.Int64)
+		t.remaining.Store(int64(maxRequests))
+	}
+	return t
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if t.remaining != nil && t.remaining.Add(-1) < 0 {
+			return nil, errRequestBudget
+		}
+		if attempt > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= t.maxRetries || !retryable(req, resp, err) {
+			return resp, err
+		}
+
+		delay := backoff(attempt)
+		reason := "network error"
+		if resp != nil {
+			reason = fmt.Sprintf("HTTP %d", resp.StatusCode)
+			if after, ok := retryAfter(resp); ok {
+				if after > retryMaxDelay {
+					// Waiting that long is not worth it; let the caller see
+					// the failure.
+					return resp, nil
+				}
+				delay = after
+			}
+			// Drain the body so the connection can be reused.
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		logf("  Retrying %s in %s (%s)\n", req.URL.Host+req.URL.Path, delay.Round(time.Millisecond), reason)
+		logEvent("retry", "url", req.URL.Host+req.URL.Path, "attempt", attempt+1, "reason", reason, "delay_ms", ms(delay))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether a request is worth repeating: it failed with a
+// network error or a status that signals a temporary condition, and its
+// body, if any, can be sent again.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns a random delay between 0 and retryBaseDelay doubled
+// attempt times, capped at retryMaxDelay.
+func backoff(attempt int) time.Duration {
+	ceiling := retryMaxDelay
+	if attempt < 16 {
+		ceiling = min(retryBaseDelay<<attempt, retryMaxDelay)
+	}
+	return time.Duration(rand.Int64N(int64(ceiling) + 1))
+}
+
+// retryAfter parses a Retry-After header given in seconds or as a date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if when, err := http.ParseTime(v); err == nil {
+		return max(time.Until(when), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// selectTabs filters results down to the tabs chosen with --tab and
+// --exclude-tab. A pattern matches a tab when it equals the tab's ID, or
+// when it matches (exactly or as a glob, case-insensitively) either the
+// tab's title or its path through the hierarchy, e.g. "Handbook/Onboarding"
+// or "Archive/*".
+//
+// A tab is exported when it or one of its ancestors matches an include
+// pattern (or no include patterns are given), and neither it nor any
+// ancestor matches an exclude pattern. Depths are recomputed so that a
+// selected tab whose parent was left out is shown at the top level.
+func selectTabs(results []tabResult, include, exclude []string) []tabResult {
+	byID := make(map[string]*tabResult, len(results))
+	for i := range results {
+		byID[results[i].id] = &results[i]
+	}
+
+	treePaths := make(map[string]string, len(results))
+	for _, r := range results {
+		if parent, ok := treePaths[r.parentID]; ok {
+			treePaths[r.id] = parent + "/" + r.title
+		} else {
+			treePaths[r.id] = r.title
+		}
+	}
+
+	parent := func(r *tabResult) *tabResult {
+		if r.parentID == "" {
+			return nil
+		}
+		return byID[r.parentID]
+	}
+
+	// matchesUp reports whether r or any of its ancestors matches a pattern.
+	matchesUp := func(r *tabResult, patterns []string) bool {
+		for ; r != nil; r = parent(r) {
+			for _, p := range patterns {
+				if tabMatches(p, r.id, r.title, treePaths[r.id]) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	selected := make(map[string]bool)
+	var out []tabResult
+	for i := range results {
+		r := &results[i]
+		if len(include) > 0 && !matchesUp(r, include) {
+			continue
+		}
+		if matchesUp(r, exclude) {
+			continue
+		}
+		selected[r.id] = true
+
+		depth := 0
+		for p := parent(r); p != nil; p = parent(p) {
+			if selected[p.id] {
+				depth++
+			}
+		}
+		sel := *r
+		sel.depth = depth
+		out = append(out, sel)
+	}
+	return out
+}
+
+func tabMatches(pattern, id, title, treePath string) bool {
+	if pattern == id {
+		return true
+	}
+	pattern = strings.ToLower(pattern)
+	for _, name := range []string{strings.ToLower(title), strings.ToLower(treePath)} {
+		if pattern == name {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSelectTabs(t *testing.T) {
+	// Handbook
+	//   Onboarding
+	//     Day one
+	//   Policies
+	// Archive
+	//   Old notes
+	tabs := []tabResult{
+		{id: "t.handbook", title: "Handbook"},
+		{id: "t.onboarding", title: "Onboarding", parentID: "t.handbook", depth: 1},
+		{id: "t.dayone", title: "Day one", parentID: "t.onboarding", depth: 2},
+		{id: "t.policies", title: "Policies", parentID: "t.handbook", depth: 1},
+		{id: "t.archive", title: "Archive"},
+		{id: "t.old", title: "Old notes", parentID: "t.archive", depth: 1},
+	}
+
+	for _, tc := range []struct {
+		include, exclude []string
+		want             string // selected tab titles with their depths
+	}{
+		{nil, nil, "Handbook:0 Onboarding:1 Day one:2 Policies:1 Archive:0 Old notes:1"},
+		{[]string{"Handbook"}, nil, "Handbook:0 Onboarding:1 Day one:2 Policies:1"},
+		{[]string{"onboarding"}, nil, "Onboarding:0 Day one:1"},
+		{[]string{"t.policies"}, nil, "Policies:0"},
+		{[]string{"Handbook/Onboarding/*"}, nil, "Day one:0"},
+		{[]string{"Archive/*"}, nil, "Old notes:0"},
+		{[]string{"Day one", "Handbook"}, []string{"Onboarding"}, "Handbook:0 Policies:1"},
+		{nil, []string{"Archive"}, "Handbook:0 Onboarding:1 Day one:2 Policies:1"},
+		{nil, []string{"*"}, ""},
+		{[]string{"No such tab"}, nil, ""},
+	} {
+		var got []string
+		for _, r := range selectTabs(tabs, tc.include, tc.exclude) {
+			got = append(got, fmt.Sprintf("%s:%d", r.title, r.depth))
+		}
+		if s := strings.Join(got, " "); s != tc.want {
+			t.Errorf("selectTabs(include %q, exclude %q) = %q, want %q", tc.include, tc.exclude, s, tc.want)
+		}
+	}
+
+	// The input is left alone.
+	if !slices.ContainsFunc(tabs, func(r tabResult) bool { return r.id == "t.dayone" && r.depth == 2 }) {
+		t.Error("selectTabs modified its input")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// renderSingleFile concatenates converted tabs in tree order into one
+// markdown document with a generated table of contents at the top.
+func renderSingleFile(results []tabResult) string {
+	anchors := make(anchorSet)
+	anchors.unique("Table of Contents")
+
+	var toc, body strings.Builder
+	toc.WriteString("# Table of Contents\n\n")
+	for _, r := range results {
+		// Every heading is registered, in document order, so that anchors
+		// repeated across tabs are suffixed the way renderers will do it.
+		for i, h := range r.result.Headings {
+			anchor := anchors.unique(h.Text)
+			if i == 0 {
+				indent := strings.Repeat("  ", r.depth)
+				toc.WriteString(fmt.Sprintf("%s- [%s](#%s)\n", indent, r.title, anchor))
+			}
+		}
+		body.WriteString(strings.TrimRight(r.result.Markdown, "\n"))
+		body.WriteString("\n\n")
+	}
+	toc.WriteString("\n")
+	return toc.String() + body.String()
+}
+
+// anchorSet hands out GitHub-style heading anchors, de-duplicating repeats
+// with a numeric suffix (foo, foo-1, foo-2, ...).
+type anchorSet map[string]bool
+
+func (s anchorSet) unique(text string) string {
+	base := headingAnchor(text)
+	anchor := base
+	for n := 1; s[anchor]; n++ {
+		anchor = fmt.Sprintf("%s-%d", base, n)
+	}
+	s[anchor] = true
+	return anchor
+}
+
+var (
+	mdImagePattern = regexp.MustCompile(`!\[[^\]]*\]\([^)]*\)`)
+	mdLinkPattern  = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+)
+
+// headingAnchor derives the anchor GitHub generates for a heading: the
+// rendered text lowercased, punctuation removed and spaces turned into hyphens.
+func headingAnchor(text string) string {
+	text = mdImagePattern.ReplaceAllString(text, "")
+	text = mdLinkPattern.ReplaceAllString(text, "$1")
+
+	var sb strings.Builder
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '-', r == '_':
+			sb.WriteRune(r)
+		case r == ' ':
+			sb.WriteRune('-')
+		}
+	}
+	return sb.String()
+}
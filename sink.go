@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// outputSink receives the files an export produces, so the export itself
+// does not care whether they end up in a directory, an archive or on
+// stdout. Nothing reaches the destination before Commit; Abort discards
+// everything written so far.
+type outputSink interface {
+	// WriteFile stores data as the slash-separated relative path rel.
+	WriteFile(rel string, data []byte) error
+	// Path returns a local file to write rel to directly, for content
+	// streamed from the network such as images.
+	Path(rel string) (string, error)
+	// Remove deletes rel from the destination on commit.
+	Remove(rel string)
+	Commit() error
+	Abort()
+}
+
+// streamOut is where "-o -" writes Markdown. It is stdout as the process
+// started, before main redirects progress output to stderr.
+var streamOut io.Writer = os.Stdout
+
+// newOutputSink returns the sink for an -o argument: "-" for stdout, a path
+// ending in .zip, .tar.gz or .tgz for an archive, anything else for a
+// directory.
+func newOutputSink(output string) (outputSink, error) {
+	switch {
+	case output == "-":
+		return &streamSink{w: streamOut}, nil
+	case archiveFormat(output) != "":
+		stage, err := newStagedDir(output)
+		if err != nil {
+			return nil, err
+		}
+		return &archiveSink{stagedDir: stage, format: archiveFormat(output)}, nil
+	default:
+		return newStagedDir(output)
+	}
+}
+
+// isDirOutput reports whether an -o argument names a directory, which is
+// the only destination that keeps a manifest between exports.
+func isDirOutput(output string) bool {
+	return output != "-" && archiveFormat(output) == ""
+}
+
+// archiveFormat returns "zip" or "tar.gz" for archive file names, and ""
+// for anything else.
+func archiveFormat(output string) string {
+	lower := strings.ToLower(output)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	}
+	return ""
+}
+
+// streamSink writes a single Markdown file to w, for "-o -". Images have
+// nowhere to go and are refused.
+type streamSink struct {
+	w    io.Writer
+	data []byte
+	rel  string
+}
+
+func (s *streamSink) WriteFile(rel string, data []byte) error {
+	if s.rel != "" {
+		return fmt.Errorf("cannot write both %s and %s to stdout", s.rel, rel)
+	}
+	s.rel, s.data = rel, data
+	return nil
+}
+
+func (s *streamSink) Path(rel string) (string, error) {
+	return "", fmt.Errorf("cannot write %s to stdout", rel)
+}
+
+func (s *streamSink) Remove(string) {}
+
+func (s *streamSink) Commit() error {
+	_, err := s.w.Write(s.data)
+	return err
+}
+
+func (s *streamSink) Abort() {}
+
+// archiveSink collects an export in a staging directory and packs it into
+// a zip or gzipped tar archive on commit. The archive is written to a
+// temporary file first and renamed over the target, so an existing archive
+// is only replaced by a complete one.
+type archiveSink struct {
+	*stagedDir
+	format string
+}
+
+// Remove does nothing: the archive is rebuilt from scratch every time.
+func (s *archiveSink) Remove(string) {}
+
+func (s *archiveSink) Commit() error {
+	defer s.Abort()
+
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.target), "."+filepath.Base(s.target)+".gdoc2md-")
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if s.format == "zip" {
+		err = writeZip(tmp, s.dir, files)
+	} else {
+		err = writeTarGz(tmp, s.dir, files)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.target)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.target, err)
+	}
+	return nil
+}
+
+func writeZip(w io.Writer, dir string, files []string) error {
+	zw := zip.NewWriter(w)
+	for _, rel := range files {
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		hdr.Method = zip.Deflate
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if err := copyFile(fw, p); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarGz(w io.Writer, dir string, files []string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, rel := range files {
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    rel,
+			Mode:    0644,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := copyFile(tw, p); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
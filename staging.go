@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// stagedDir collects the files of an export in a temporary directory next
+// to the output directory, and moves them into place only once everything
+// has been written. Files replaced or removed in the output directory are
+// moved to a backup directory first, so a failed commit can be rolled back;
+// the backup is deleted once the commit succeeds.
+type stagedDir struct {
+	target  string // the real output directory
+	dir     string // staging directory
+	removed []string
+}
+
+// newStagedDir creates a staging directory for target. It is placed next
+// to target so both are on the same filesystem and files can be renamed
+// into place; if the parent directory is not writable, it is created
+// inside target instead.
+func newStagedDir(target string) (*stagedDir, error) {
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(abs), "."+filepath.Base(abs)+".gdoc2md-staging-")
+	if err != nil {
+		if _, statErr := os.Stat(abs); statErr != nil {
+			return nil, fmt.Errorf("failed to create staging directory: %w", err)
+		}
+		if dir, err = os.MkdirTemp(abs, ".gdoc2md-staging-"); err != nil {
+			return nil, fmt.Errorf("failed to create staging directory: %w", err)
+		}
+	}
+	// MkdirTemp uses 0700; the staging directory may become the output
+	// directory itself.
+	if err := os.Chmod(dir, 0755); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &stagedDir{target: abs, dir: dir}, nil
+}
+
+// Path returns where the slash-separated relative path rel is staged,
+// creating its parent directories. Whatever exists in the staging
+// directory at commit time is moved into place.
+func (s *stagedDir) Path(rel string) (string, error) {
+	p := filepath.Join(s.dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// WriteFile stages data as the slash-separated relative path rel.
+func (s *stagedDir) WriteFile(rel string, data []byte) error {
+	p, err := s.Path(rel)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data, 0644)
+}
+
+// Remove schedules rel to be removed from the output directory on commit.
+func (s *stagedDir) Remove(rel string) {
+	s.removed = append(s.removed, rel)
+}
+
+// Abort discards everything staged, leaving the output directory untouched.
+func (s *stagedDir) Abort() {
+	os.RemoveAll(s.dir)
+}
+
+// Commit moves the staged files into the output directory.
+func (s *stagedDir) Commit() error {
+	if _, err := os.Stat(s.target); os.IsNotExist(err) {
+		if err := os.Rename(s.dir, s.target); err != nil {
+			s.Abort()
+			return fmt.Errorf("failed to move export into place: %w", err)
+		}
+		return nil
+	}
+	defer s.Abort()
+
+	written, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	backup, err := os.MkdirTemp(filepath.Dir(s.dir), "."+filepath.Base(s.target)+".gdoc2md-backup-")
+	if err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	var backedUp, placed []string
+	rollback := func() error {
+		for _, rel := range placed {
+			os.Remove(filepath.Join(s.target, filepath.FromSlash(rel)))
+		}
+		for _, rel := range backedUp {
+			if err := move(filepath.Join(backup, filepath.FromSlash(rel)), filepath.Join(s.target, filepath.FromSlash(rel))); err != nil {
+				return fmt.Errorf("%w; previous files remain in %s", err, backup)
+			}
+		}
+		return os.RemoveAll(backup)
+	}
+
+	for _, rel := range append(written, s.removed...) {
+		dst := filepath.Join(s.target, filepath.FromSlash(rel))
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			continue
+		}
+		if err := move(dst, filepath.Join(backup, filepath.FromSlash(rel))); err != nil {
+			if rbErr := rollback(); rbErr != nil {
+				return fmt.Errorf("failed to back up %s: %w (rollback failed: %v)", dst, err, rbErr)
+			}
+			return fmt.Errorf("failed to back up %s: %w", dst, err)
+		}
+		backedUp = append(backedUp, rel)
+	}
+
+	for _, rel := range written {
+		dst := filepath.Join(s.target, filepath.FromSlash(rel))
+		if err := move(filepath.Join(s.dir, filepath.FromSlash(rel)), dst); err != nil {
+			if rbErr := rollback(); rbErr != nil {
+				return fmt.Errorf("failed to move %s into place: %w (rollback failed: %v)", dst, err, rbErr)
+			}
+			return fmt.Errorf("failed to move %s into place: %w", dst, err)
+		}
+		placed = append(placed, rel)
+	}
+
+	removeEmptyDirs(s.target, s.removed)
+	return os.RemoveAll(backup)
+}
+
+// files lists the staged files as slash-separated relative paths.
+func (s *stagedDir) files() ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, err
+}
+
+// move renames src to dst, creating dst's parent directories.
+func move(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+// removeEmptyDirs removes the directories containing the given relative
+// paths, deepest first, up to but excluding root. Directories that are not
+// empty are left alone.
+func removeEmptyDirs(root string, paths []string) {
+	dirs := make(map[string]bool)
+	for _, rel := range paths {
+		for dir := filepath.Dir(filepath.Join(root, filepath.FromSlash(rel))); dir != filepath.Clean(root); dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	var sorted []string
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, dir := range sorted {
+		_ = os.Remove(dir)
+	}
+}
+
+// writeFileAtomic writes data to path through a temporary file in the same
+// directory that is renamed into place, so path never holds partial
+// content, even if the process is interrupted.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return createAtomic(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// createAtomic creates path with the content written by write, through a
+// temporary file that is renamed into place only if write succeeds. On
+// failure the temporary file is removed and path is left untouched.
+func createAtomic(path string, perm os.FileMode, write func(w io.Writer) error) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
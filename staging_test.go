@@ -0,0 +1,102 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStagedDirCommit(t *testing.T) {
+	parent := t.TempDir()
+	target := filepath.Join(parent, "out")
+	writeTestFiles(t, target, map[string]string{"a.md": "old", "gone/b.md": "old", "keep.md": "old"})
+
+	s, err := newStagedDir(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rel, data := range map[string]string{"a.md": "new", "c/d.md": "new"} {
+		if err := s.WriteFile(rel, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Remove("gone/b.md")
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readTree(t, target), map[string]string{"a.md": "new", "c/d.md": "new", "keep.md": "old"}; !maps.Equal(got, want) {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(target, "gone")); !os.IsNotExist(err) {
+		t.Errorf("emptied directory was not removed: %v", err)
+	}
+	assertOnlyEntry(t, parent, "out")
+}
+
+func TestStagedDirCommitRollback(t *testing.T) {
+	parent := t.TempDir()
+	target := filepath.Join(parent, "out")
+	writeTestFiles(t, target, map[string]string{"a.md": "old", "gone.md": "old"})
+	// b is a dangling symlink: there is nothing to back up at b/c.md, but
+	// its directory cannot be created, so moving it into place fails after
+	// a.md has been replaced.
+	if err := os.Symlink(filepath.Join(target, "missing"), filepath.Join(target, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newStagedDir(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rel, data := range map[string]string{"a.md": "new", "b/c.md": "new"} {
+		if err := s.WriteFile(rel, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Remove("gone.md")
+	if err := s.Commit(); err == nil {
+		t.Fatal("Commit succeeded, want an error")
+	}
+
+	for _, rel := range []string{"a.md", "gone.md"} {
+		if data, err := os.ReadFile(filepath.Join(target, rel)); err != nil || string(data) != "old" {
+			t.Errorf("%s = %q, %v; want the old content", rel, data, err)
+		}
+	}
+	if fi, err := os.Lstat(filepath.Join(target, "b")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symlink b was not left alone: %v", err)
+	}
+	assertOnlyEntry(t, parent, "out")
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for rel, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// assertOnlyEntry checks that the staging and backup directories were
+// cleaned up, leaving only name in dir.
+func assertOnlyEntry(t *testing.T, dir, name string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != name {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("%s contains %q, want only %q", dir, names, name)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// syncConfigFiles are the project files sync looks for in the current
+// directory when none is given.
+var syncConfigFiles = []string{"gdoc2md.yaml", "gdoc2md.yml", "gdoc2md.json"}
+
+// SyncConfig is a project file listing the documents to export, read by
+// the sync command:
+//
+//	defaults:
+//	  filenames: slug
+//	documents:
+//	  - url: https://docs.google.com/document/d/DOC_ID/edit
+//	    output: docs/handbook
+//	    exclude_tabs: [Drafts]
+//	  - folder: https://drive.google.com/drive/folders/FOLDER_ID
+//	    output: docs/team
+//	    nested: true
+type SyncConfig struct {
+	Defaults  SyncOptions    `yaml:"defaults" json:"defaults"`
+	Documents []SyncDocument `yaml:"documents" json:"documents"`
+}
+
+// SyncOptions are the export options a project file may set, for all
+// documents or for one. Unset options keep the value from the command line.
+type SyncOptions struct {
+	SingleFile  *bool    `yaml:"single_file" json:"single_file"`
+	Nested      *bool    `yaml:"nested" json:"nested"`
+	NestedIndex string   `yaml:"nested_index" json:"nested_index"`
+	Filenames   string   `yaml:"filenames" json:"filenames"`
+	Tabs        []string `yaml:"tabs" json:"tabs"`
+	ExcludeTabs []string `yaml:"exclude_tabs" json:"exclude_tabs"`
+	Prune       *bool    `yaml:"prune" json:"prune"`
+
+	ImageDir     string `yaml:"image_dir" json:"image_dir"`
+	ImageURL     string `yaml:"image_url" json:"image_url"`
+	ImagesPerTab *bool  `yaml:"images_per_tab" json:"images_per_tab"`
+}
+
+// SyncDocument is one entry of a project file: a document or a Drive
+// folder, and where to write it relative to the project file.
+type SyncDocument struct {
+	URL         string `yaml:"url" json:"url"`
+	Folder      string `yaml:"folder" json:"folder"`
+	Output      string `yaml:"output" json:"output"`
+	SyncOptions `yaml:",inline"`
+}
+
+// findSyncConfig returns the project file in the current directory.
+func findSyncConfig() (string, error) {
+	for _, name := range syncConfigFiles {
+		if _, err := os.Stat(name); err == nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no project file found (looked for %s)", strings.Join(syncConfigFiles, ", "))
+}
+
+// loadSyncConfig reads and validates a project file. Files ending in .json
+// are read as JSON, anything else as YAML; unknown keys are rejected so
+// typos do not go unnoticed.
+func loadSyncConfig(path string) (*SyncConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg SyncConfig
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err = dec.Decode(&cfg); errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if len(cfg.Documents) == 0 {
+		return nil, fmt.Errorf("%s lists no documents", path)
+	}
+	if _, err := cfg.Defaults.apply(ExportOptions{}); err != nil {
+		return nil, fmt.Errorf("%s: defaults: %w", path, err)
+	}
+	outputs := make(pathSet)
+	for i, d := range cfg.Documents {
+		entry := fmt.Sprintf("%s: document %d", path, i+1)
+		switch {
+		case d.URL == "" && d.Folder == "":
+			return nil, fmt.Errorf("%s: one of url or folder is required", entry)
+		case d.URL != "" && d.Folder != "":
+			return nil, fmt.Errorf("%s: url and folder cannot both be set", entry)
+		case d.Output == "":
+			return nil, fmt.Errorf("%s: output is required", entry)
+		}
+		if !outputs.claim(filepath.ToSlash(filepath.Clean(d.Output))) {
+			return nil, fmt.Errorf("%s: output %s is used by another document", entry, d.Output)
+		}
+		if _, err := d.apply(ExportOptions{}); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// apply returns base with the options set in o.
+func (o SyncOptions) apply(base ExportOptions) (ExportOptions, error) {
+	if o.SingleFile != nil {
+		base.SingleFile = *o.SingleFile
+	}
+	if o.Nested != nil {
+		base.Nested = *o.Nested
+	}
+	if o.NestedIndex != "" {
+		name, err := cleanNestedIndex(o.NestedIndex)
+		if err != nil {
+			return base, err
+		}
+		base.NestedIndex = name
+	}
+	if o.Filenames != "" {
+		namer, err := newFilenamer(o.Filenames)
+		if err != nil {
+			return base, err
+		}
+		base.Filenames = namer
+	}
+	if o.Tabs != nil {
+		base.Tabs = slices.Clone(o.Tabs)
+	}
+	if o.ExcludeTabs != nil {
+		base.ExcludeTabs = slices.Clone(o.ExcludeTabs)
+	}
+	if o.Prune != nil {
+		base.Prune = *o.Prune
+	}
+	if o.ImageDir != "" {
+		dir, err := cleanImageDir(o.ImageDir)
+		if err != nil {
+			return base, err
+		}
+		base.ImageDir = dir
+	}
+	if o.ImageURL != "" {
+		base.ImageURL = o.ImageURL
+	}
+	if o.ImagesPerTab != nil {
+		base.ImagesPerTab = *o.ImagesPerTab
+	}
+	return base, nil
+}
+
+// runSync exports every document listed in a project file. Options from
+// the command line are the starting point for every document; the file's
+// defaults and then each entry's own options override them. Output paths
+// are relative to the project file. A failed entry does not stop the others.
+func runSync(ctx context.Context, configPath string, opts ExportOptions) error {
+	if configPath == "" {
+		var err error
+		if configPath, err = findSyncConfig(); err != nil {
+			return err
+		}
+	}
+	cfg, err := loadSyncConfig(configPath)
+	if err != nil {
+		return err
+	}
+	base, _ := cfg.Defaults.apply(opts)
+
+	client, err := GetAuthenticatedClient(ctx)
+	if err != nil {
+		return err
+	}
+	x, err := newExporter(ctx, client, opts.Concurrency)
+	if err != nil {
+		return err
+	}
+
+	root := filepath.Dir(configPath)
+	var failed []string
+	for _, d := range cfg.Documents {
+		if ctx.Err() != nil {
+			failed = append(failed, d.Output)
+			continue
+		}
+		outputDir := filepath.Join(root, filepath.FromSlash(d.Output))
+		logf("\n==> %s\n", outputDir)
+		if err := syncDocument(ctx, x, d, outputDir, base); err != nil {
+			errorf("%s: %v\n", d.Output, err)
+			failed = append(failed, d.Output)
+		}
+	}
+
+	logf("\nSynced %d of %d document(s)\n", len(cfg.Documents)-len(failed), len(cfg.Documents))
+	if len(failed) > 0 {
+		return fmt.Errorf("sync failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// syncDocument exports one project file entry into outputDir. Folder
+// entries share x's image download pool with the rest of the run.
+func syncDocument(ctx context.Context, x *exporter, d SyncDocument, outputDir string, base ExportOptions) error {
+	opts, _ := d.apply(base)
+
+	if d.Folder != "" {
+		folderID, err := parseFolderURL(d.Folder)
+		if err != nil {
+			return err
+		}
+		return x.exportFolder(ctx, folderID, outputDir, opts)
+	}
+
+	docID, tabID, err := parseDocURL(d.URL)
+	if err != nil {
+		return err
+	}
+	if tabID != "" {
+		opts.Tabs = append(slices.Clone(opts.Tabs), tabID)
+	}
+	_, err = x.export(ctx, docID, outputDir, opts)
+	return err
+}
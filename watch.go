@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// runWatch exports a document and then keeps it up to date, re-exporting
+// whenever its revision changes, until interrupted.
+func runWatch(ctx context.Context, input, outputDir string, opts ExportOptions, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %s", interval)
+	}
+	docID, tabID, err := parseDocURL(input)
+	if err != nil {
+		return err
+	}
+	if tabID != "" {
+		opts.Tabs = append(opts.Tabs, tabID)
+	}
+
+	client, err := GetAuthenticatedClient(ctx)
+	if err != nil {
+		return err
+	}
+	x, err := newExporter(ctx, client, opts.Concurrency)
+	if err != nil {
+		return err
+	}
+	return x.watch(ctx, docID, outputDir, opts, interval)
+}
+
+// watch polls the document's revision ID every interval and exports it
+// into outputDir whenever it changes, printing the tabs that changed. It
+// returns nil once ctx is cancelled; an export interrupted that way is
+// discarded, leaving the previous one in place. Errors after the first
+// export are reported and watching continues.
+//
+// Documents that do not expose a revision ID (it requires edit access) are
+// re-exported on every poll; unchanged files are still left untouched.
+func (x *exporter) watch(ctx context.Context, docID, outputDir string, opts ExportOptions, interval time.Duration) error {
+	report, err := x.export(ctx, docID, outputDir, opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			logf("\nInterrupted; nothing was written.\n")
+			return nil
+		}
+		return err
+	}
+	revision := report.RevisionID
+	printChangedTabs(report)
+
+	logf("\nWatching %s every %s (press Ctrl-C to stop)...\n", docID, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logf("\nStopped watching.\n")
+			return nil
+		case <-ticker.C:
+		}
+
+		meta, err := x.srv.Documents.Get(docID).Fields("revisionId").Context(ctx).Do()
+		if err != nil {
+			if ctx.Err() == nil {
+				warnf("failed to check revision: %v\n", err)
+			}
+			continue
+		}
+		if meta.RevisionId != "" && meta.RevisionId == revision {
+			continue
+		}
+
+		logf("\n[%s] Document changed (revision %s)\n", time.Now().Format(time.TimeOnly), meta.RevisionId)
+		logEvent("revision_changed", "doc_id", docID, "revision_id", meta.RevisionId)
+		report, err := x.export(ctx, docID, outputDir, opts)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			logf("\nInterrupted; the previous export was left in place.\n")
+			return nil
+		case err != nil:
+			warnf("export failed: %v\n", err)
+			continue
+		}
+		revision = report.RevisionID
+		printChangedTabs(report)
+	}
+}
+
+// printChangedTabs lists the tabs an export rewrote.
+func printChangedTabs(report *ExportReport) {
+	switch {
+	case report.Unchanged:
+	case len(report.Changed) == 0:
+		logf("No tabs changed.\n")
+	default:
+		logf("Changed %d tab(s):\n", len(report.Changed))
+		for _, title := range report.Changed {
+			logf("  - %s\n", title)
+		}
+	}
+}